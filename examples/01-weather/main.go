@@ -18,39 +18,41 @@ import (
 	"flag"
 	"fmt"
 	"github.com/kurrik/witgo/v1/witgo"
+	"log/slog"
 	"os"
 )
 
 type Handler struct {
 }
 
+type Slots struct {
+	Location string `witgo:"location,required"`
+}
+
 func NewHandler() *Handler {
 	return &Handler{}
 }
 
-func (h *Handler) Action(session *witgo.Session, action string) (response *witgo.Session, err error) {
+func (h *Handler) Action(session *witgo.Session, entities witgo.EntityMap, action string) (response *witgo.Session, err error) {
 	response = session
 	response.Context.Set("forecast", "sunny")
 	return
 }
 
-func (h *Handler) Say(session *witgo.Session, msg string) (response *witgo.Session, err error) {
-	response = session
-	fmt.Printf("< %v\n", msg)
-	return
-}
-
 func (h *Handler) Merge(session *witgo.Session, entities witgo.EntityMap) (response *witgo.Session, err error) {
 	var (
-		value string
+		slots   Slots
+		missing []string
 	)
 	response = session
-	if value, err = entities.FirstEntityValue("location"); err != nil {
+	if missing, err = entities.Decode(&slots); err != nil {
+		return
+	}
+	if len(missing) > 0 {
 		response.Context = witgo.Context{}
-		err = nil
 	} else {
 		response.Context.Merge(witgo.Context{
-			"loc": value,
+			"loc": slots.Location,
 		})
 	}
 	return
@@ -79,11 +81,13 @@ func main() {
 	if token == "" {
 		processError(fmt.Errorf("You must specify a server access token using the -token flag!"))
 	}
-	client = witgo.NewClient(token)
+	client = witgo.NewClient(token, witgo.WithEnvironmentProxy())
+	wg = witgo.NewWitgo(client, NewHandler())
 	if debug {
 		client.HttpClient = witgo.NewLoggingHttpClient(os.Stderr, client.HttpClient)
+		client.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		wg.Logger = client.Logger
 	}
-	wg = witgo.NewWitgo(client, NewHandler())
 	input = witgo.NewInteractiveInput()
 	if err = wg.Process(input); err != nil {
 		processError(err)
@@ -0,0 +1,167 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package twitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kurrik/oauth1a"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TwitterUser struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	ScreenName string `json:"screen_name"`
+	Following  bool   `json:"following"`
+}
+
+type DirectMessage struct {
+	ID        int64       `json:"id"`
+	Text      string      `json:"text"`
+	Sender    TwitterUser `json:"sender"`
+	Recipient TwitterUser `json:"recipient"`
+	CreatedAt string      `json:"created_at"`
+}
+
+type DirectMessageList []DirectMessage
+
+func (l DirectMessageList) Len() int           { return len(l) }
+func (l DirectMessageList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l DirectMessageList) Less(i, j int) bool { return l[i].ID < l[j].ID }
+
+// Signs requests before they are sent to the Twitter API.
+type Authorizer interface {
+	Authorize(req *http.Request) (err error)
+}
+
+type oauthAuthorizer struct {
+	service *oauth1a.Service
+	user    *oauth1a.UserConfig
+}
+
+// Creates an Authorizer which signs requests with OAuth 1.0a user credentials.
+func NewOAuthAuthorizer(consumerKey, consumerSecret, accessToken, accessTokenSecret string) Authorizer {
+	return &oauthAuthorizer{
+		service: &oauth1a.Service{
+			ClientConfig: &oauth1a.ClientConfig{
+				ConsumerKey:    consumerKey,
+				ConsumerSecret: consumerSecret,
+			},
+			Signer: new(oauth1a.HmacSha1Signer),
+		},
+		user: oauth1a.NewAuthorizedConfig(accessToken, accessTokenSecret),
+	}
+}
+
+func (a *oauthAuthorizer) Authorize(req *http.Request) error {
+	return a.service.Sign(req, a.user)
+}
+
+// Returned when the Twitter API rate limit has been exceeded.
+type RateLimitError struct {
+	Limit     uint32
+	Remaining uint32
+	Reset     time.Time
+}
+
+func (e RateLimitError) Error() string {
+	return fmt.Sprintf("Rate limit: %v, Remaining: %v, Reset: %v", e.Limit, e.Remaining, e.Reset)
+}
+
+// Returns how long to wait until the rate limit resets.
+func (e RateLimitError) RetryAfter() time.Duration {
+	return e.Reset.Sub(time.Now()) + time.Second
+}
+
+// Returned when the Twitter API responds with an error.
+type ResponseError struct {
+	Code int
+	Body string
+}
+
+func (e ResponseError) Error() string {
+	return fmt.Sprintf("Unable to handle response with code %d: `%v`", e.Code, e.Body)
+}
+
+func (a *Adapter) sendRequest(method string, path string, query url.Values, out interface{}) (err error) {
+	var (
+		req  *http.Request
+		resp *http.Response
+		body []byte
+	)
+	a.init()
+	if req, err = http.NewRequest(method, fmt.Sprintf("%v%v?%v", a.Base, path, query.Encode()), nil); err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/json")
+	if a.Authorizer != nil {
+		if err = a.Authorizer.Authorize(req); err != nil {
+			return
+		}
+	}
+	if resp, err = a.HttpClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	switch {
+	case resp.StatusCode == 429:
+		err = parseRateLimit(resp.Header)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		err = ResponseError{Code: resp.StatusCode, Body: string(body)}
+	case out != nil:
+		err = json.Unmarshal(body, out)
+	}
+	return
+}
+
+func parseRateLimit(header http.Header) (err RateLimitError) {
+	var (
+		limit, remaining, reset uint64
+	)
+	limit, _ = strconv.ParseUint(strings.TrimSpace(header.Get("X-Rate-Limit-Limit")), 10, 32)
+	remaining, _ = strconv.ParseUint(strings.TrimSpace(header.Get("X-Rate-Limit-Remaining")), 10, 32)
+	reset, _ = strconv.ParseUint(strings.TrimSpace(header.Get("X-Rate-Limit-Reset")), 10, 64)
+	err = RateLimitError{
+		Limit:     uint32(limit),
+		Remaining: uint32(remaining),
+		Reset:     time.Unix(int64(reset), 0),
+	}
+	return
+}
+
+func (a *Adapter) fetchDirectMessages(sinceID int64, count int) (data DirectMessageList, err error) {
+	var query = url.Values{}
+	query.Set("since_id", fmt.Sprintf("%v", sinceID))
+	query.Set("count", fmt.Sprintf("%v", count))
+	err = a.sendRequest("GET", "/1.1/direct_messages.json", query, &data)
+	return
+}
+
+func (a *Adapter) sendDirectMessage(userID int64, text string) (err error) {
+	var query = url.Values{}
+	query.Set("user_id", fmt.Sprintf("%v", userID))
+	query.Set("text", text)
+	err = a.sendRequest("POST", "/1.1/direct_messages/new.json", query, nil)
+	return
+}
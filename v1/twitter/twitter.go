@@ -0,0 +1,314 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Implements a witgo Input and Responder which converses over Twitter direct
+// messages.
+package twitter
+
+import (
+	"context"
+	"fmt"
+	"github.com/kurrik/witgo/v1/witgo"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const MINWAIT = time.Duration(10) * time.Second
+
+// Polls the direct message timeline of the authorized account for records
+// and sends messages said by the bot back as direct messages.
+//
+// Respond sends synchronously and does not retry.  Wrap the adapter in a
+// witgo.Outbox to queue messages and retry failed sends.
+//
+// Fields left zero take the defaults of NewAdapter when the adapter is first
+// used, so the zero Adapter polls the Twitter API without authorization.
+type Adapter struct {
+	HttpClient   witgo.HttpClient
+	Base         string
+	Authorizer   Authorizer
+	Checkpoints  *witgo.Checkpointer
+	PollInterval time.Duration
+	MinWait      time.Duration
+	// Returns the wait after the given number of failed fetches in a row,
+	// starting at 1.  Defaults to witgo.DefaultBackoff.  Rate limit errors
+	// wait until the limit resets instead.
+	Backoff func(attempt int) time.Duration
+	// Receives polling and delivery events.  Nil disables logging.
+	Logger *slog.Logger
+
+	fetchedToID int64
+	backlog     atomic.Int64
+	initOnce    sync.Once
+	stop        chan struct{}
+	stopOnce    sync.Once
+	done        chan struct{}
+}
+
+// Creates an adapter for the account authorized by the supplied Authorizer.
+// Set Base and HttpClient to talk to a different server.
+func NewAdapter(authorizer Authorizer) (a *Adapter) {
+	a = &Adapter{Authorizer: authorizer}
+	a.init()
+	return
+}
+
+// Sets the fields left zero to their defaults.
+func (a *Adapter) init() {
+	a.initOnce.Do(func() {
+		if a.HttpClient == nil {
+			a.HttpClient = &http.Client{}
+		}
+		if a.Base == "" {
+			a.Base = "https://api.twitter.com"
+		}
+		if a.Checkpoints == nil {
+			a.Checkpoints = newMemoryCheckpointer()
+		}
+		if a.PollInterval <= 0 {
+			a.PollInterval = time.Minute
+		}
+		if a.MinWait <= 0 {
+			a.MinWait = MINWAIT
+		}
+		if a.Backoff == nil {
+			a.Backoff = witgo.DefaultBackoff
+		}
+		a.stop = make(chan struct{})
+		a.done = make(chan struct{})
+	})
+}
+
+func (a *Adapter) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	if a.Logger != nil {
+		a.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+	}
+}
+
+func newMemoryCheckpointer() *witgo.Checkpointer {
+	var c, _ = witgo.NewCheckpointer(&witgo.MemoryCheckpointStore{})
+	return c
+}
+
+// Returns the checkpoint of the adapter.  Positions are direct message IDs.
+func (a *Adapter) Checkpointer() *witgo.Checkpointer {
+	a.init()
+	return a.Checkpoints
+}
+
+// Returns the ID of the newest processed direct message, or zero.
+func (a *Adapter) ProcessedToID() (id int64, err error) {
+	var position string
+	a.init()
+	if position = a.Checkpoints.Position(); position != "" {
+		id, err = strconv.ParseInt(position, 10, 64)
+	}
+	return
+}
+
+// Marks every direct message up to and including id as processed.
+func (a *Adapter) SetProcessedToID(id int64) error {
+	a.init()
+	return a.Checkpoints.Reset(strconv.FormatInt(id, 10))
+}
+
+// Marks every direct message currently in the timeline as processed.
+func (a *Adapter) SetProcessedMarkerToCurrent() (err error) {
+	var existing DirectMessageList
+	if existing, err = a.fetchDirectMessages(0, 1); err != nil {
+		return
+	}
+	if len(existing) > 0 {
+		err = a.SetProcessedToID(existing[0].ID)
+	}
+	return
+}
+
+// The prefix of the session IDs of Twitter users.
+const SESSION_PREFIX = "twitter:"
+
+// Returns the session for a user.  Session IDs are derived from the user ID
+// so messages queued before a restart can still be delivered.
+func (a *Adapter) sessionFor(userID int64) witgo.SessionID {
+	return witgo.SessionID(SESSION_PREFIX + strconv.FormatInt(userID, 10))
+}
+
+// Returns the user a session belongs to.
+func (a *Adapter) userFor(sessionID witgo.SessionID) (userID int64, err error) {
+	var id = string(sessionID)
+	if !strings.HasPrefix(id, SESSION_PREFIX) {
+		err = fmt.Errorf("No user associated with session %v", sessionID)
+		return
+	}
+	if userID, err = strconv.ParseInt(strings.TrimPrefix(id, SESSION_PREFIX), 10, 64); err != nil {
+		err = fmt.Errorf("No user associated with session %v", sessionID)
+	}
+	return
+}
+
+// Sleeps until a rate limit resets, or backs off after other errors.
+// Returns false if the adapter was stopped while sleeping.
+func (a *Adapter) handleError(err error, attempt int) bool {
+	var dur time.Duration
+	switch e := err.(type) {
+	case RateLimitError:
+		if dur = e.RetryAfter(); dur < a.MinWait {
+			dur = a.MinWait
+		}
+		a.log(slog.LevelWarn, "rate limited", slog.Time("reset", e.Reset), slog.Duration("wait", dur))
+	default:
+		dur = a.Backoff(attempt)
+		a.log(slog.LevelError, "fetching direct messages failed",
+			slog.Int("attempt", attempt),
+			slog.Duration("wait", dur),
+			slog.Any("error", err),
+		)
+	}
+	select {
+	case <-time.After(dur):
+		return true
+	case <-a.stop:
+		return false
+	}
+}
+
+// Returns the number of fetched direct messages not yet sent to Witgo.
+func (a *Adapter) Backlog() int {
+	return int(a.backlog.Load())
+}
+
+// Drains turns until Witgo closes the channel.
+func (a *Adapter) runTurns(turns <-chan witgo.Turn) {
+	var turn witgo.Turn
+	defer close(a.done)
+	for turn = range turns {
+		if turn.Err != nil {
+			a.log(slog.LevelError, "turn failed", slog.String("session", string(turn.SessionID)), slog.Any("error", turn.Err))
+		}
+	}
+}
+
+// Emits records for new direct messages.  Records are committed by Witgo once
+// processed, fetchedToID only tracks what has been read in this run.  Failed
+// fetches are retried until the adapter is stopped.
+func (a *Adapter) runFetch(records chan<- witgo.InputRecord) {
+	var (
+		messages DirectMessageList
+		message  DirectMessage
+		id       string
+		failures int
+		queued   int
+		err      error
+		tick     *time.Ticker
+	)
+	defer close(records)
+	if a.fetchedToID, err = a.ProcessedToID(); err != nil {
+		a.log(slog.LevelError, "loading checkpoint failed", slog.Any("error", err))
+		return
+	}
+	tick = time.NewTicker(a.PollInterval)
+	defer tick.Stop()
+	for true {
+		select {
+		case <-a.stop:
+			return
+		default:
+		}
+		a.log(slog.LevelDebug, "requesting direct messages", slog.Int64("since_id", a.fetchedToID))
+		if messages, err = a.fetchDirectMessages(a.fetchedToID, 100); err != nil {
+			if failures++; !a.handleError(err, failures) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		a.log(slog.LevelDebug, "fetched direct messages", slog.Int("count", len(messages)))
+		sort.Sort(messages)
+		for _, message = range messages {
+			if message.ID > a.fetchedToID {
+				queued++
+			}
+		}
+		for _, message = range messages {
+			if message.ID > a.fetchedToID {
+				queued--
+				a.backlog.Store(int64(queued))
+				id = strconv.FormatInt(message.ID, 10)
+				select {
+				case records <- witgo.InputRecord{
+					SessionID: a.sessionFor(message.Sender.ID),
+					Query:     message.Text,
+					ID:        id,
+					Position:  id,
+				}:
+				case <-a.stop:
+					return
+				}
+				a.fetchedToID = message.ID
+			}
+		}
+		select {
+		case <-tick.C:
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+func (a *Adapter) Run(turns <-chan witgo.Turn) <-chan witgo.InputRecord {
+	var records = make(chan witgo.InputRecord)
+	a.init()
+	go a.runTurns(turns)
+	go a.runFetch(records)
+	return records
+}
+
+// Sends a direct message to the user the session belongs to.
+// Rate limit errors can be retried after RateLimitError.RetryAfter and
+// server errors can be retried; other 4xx errors are permanent.
+func (a *Adapter) Respond(sessionID witgo.SessionID, msg string) (err error) {
+	var userID int64
+	a.init()
+	if userID, err = a.userFor(sessionID); err != nil {
+		return witgo.Permanent(err)
+	}
+	a.log(slog.LevelDebug, "sending direct message", slog.Int64("user_id", userID))
+	if err = a.sendDirectMessage(userID, msg); err != nil {
+		if e, ok := err.(ResponseError); ok && e.Code >= 400 && e.Code < 500 && e.Code != 429 {
+			err = witgo.Permanent(err)
+		}
+	}
+	return
+}
+
+// Stops polling for new direct messages.  Done is closed once Witgo has
+// finished processing the records already read.
+func (a *Adapter) Stop() {
+	a.init()
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+}
+
+// Closed once Witgo has stopped sending turns to the adapter.
+func (a *Adapter) Done() <-chan struct{} {
+	a.init()
+	return a.done
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package twitter
+
+import (
+	"encoding/json"
+	"github.com/kurrik/witgo/v1/witgo"
+	"github.com/kurrik/witgo/v1/witgo/witgotest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type noAuth struct{}
+
+func (noAuth) Authorize(req *http.Request) error {
+	return nil
+}
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	var (
+		id     = NewAdapter(noAuth{}).sessionFor(12345)
+		userID int64
+		err    error
+	)
+	if id != "twitter:12345" {
+		t.Fatalf("Unexpected session ID %v", id)
+	}
+	if userID, err = NewAdapter(noAuth{}).userFor(id); err != nil || userID != 12345 {
+		t.Fatalf("Expected user 12345 from new adapter, got %v, %v", userID, err)
+	}
+	for _, bad := range []witgo.SessionID{"", "12345", "twitter:", "twitter:abc", "other:1"} {
+		if _, err = NewAdapter(noAuth{}).userFor(bad); err == nil {
+			t.Errorf("Expected error for session %q", bad)
+		}
+	}
+}
+
+func TestRespondClassifiesErrors(t *testing.T) {
+	var tests = []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusBadRequest, true},
+		{http.StatusForbidden, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(`{}`))
+		}))
+		adapter := NewAdapter(noAuth{})
+		adapter.Base = server.URL
+		err := adapter.Respond(adapter.sessionFor(1), "hi")
+		server.Close()
+		if test.status == http.StatusOK {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", test.status, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%v: expected error", test.status)
+			continue
+		}
+		if witgo.IsPermanent(err) != test.permanent {
+			t.Errorf("%v: permanent = %v, want %v (%v)", test.status, !test.permanent, test.permanent, err)
+		}
+	}
+}
+
+// Serves the direct message endpoints of the Twitter API.  Fetches fail with
+// a 500 while failures is positive.
+type fakeTwitter struct {
+	mu       sync.Mutex
+	messages DirectMessageList
+	failures int
+	fetches  int
+	sent     []url.Values
+}
+
+func (f *fakeTwitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		sinceID, _ = strconv.ParseInt(r.URL.Query().Get("since_id"), 10, 64)
+		out        = DirectMessageList{}
+	)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/1.1/direct_messages.json":
+		if f.fetches++; f.failures > 0 {
+			f.failures--
+			http.Error(w, `{"errors": []}`, http.StatusInternalServerError)
+			return
+		}
+		for _, message := range f.messages {
+			if message.ID > sinceID {
+				out = append(out, message)
+			}
+		}
+		json.NewEncoder(w).Encode(out)
+	case "/1.1/direct_messages/new.json":
+		f.sent = append(f.sent, r.URL.Query())
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeTwitter) sentCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sent)
+}
+
+// A Handler leaving delivery to the Responder.
+type plainHandler struct{}
+
+func (plainHandler) Action(session *witgo.Session, entities witgo.EntityMap, action string) (*witgo.Session, error) {
+	return session, nil
+}
+
+func (plainHandler) Merge(session *witgo.Session, entities witgo.EntityMap) (*witgo.Session, error) {
+	return session, nil
+}
+
+func (plainHandler) Error(session *witgo.Session, msg string) {}
+
+// Runs the adapter against twitter until it has replied want times, and
+// returns the queries sent to wit.ai.
+func runAdapter(t *testing.T, twitter *httptest.Server, fake *fakeTwitter, store witgo.CheckpointStore, want int) (queries []string) {
+	var (
+		wit     = witgotest.NewServer()
+		adapter = &Adapter{Base: twitter.URL, PollInterval: 5 * time.Millisecond}
+		wg      = witgo.NewWitgo(wit.Client, plainHandler{})
+		done    = make(chan error)
+		err     error
+	)
+	defer wit.Close()
+	for i := 0; i < want; i++ {
+		wit.AddConverse("", &witgo.ConverseResponse{Type: "msg", Msg: "Got it"}, &witgo.ConverseResponse{Type: "stop"})
+	}
+	if adapter.Checkpoints, err = witgo.NewCheckpointer(store); err != nil {
+		t.Fatal(err)
+	}
+	adapter.Backoff = func(attempt int) time.Duration { return time.Millisecond }
+	wg.Responder = adapter
+	go func() { done <- wg.Process(adapter) }()
+	for deadline := time.Now().Add(5 * time.Second); fake.sentCount() < want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v replies, got %v", want, fake.sentCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	adapter.Stop()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	<-adapter.Done()
+	for _, req := range wit.RequestsFor("/converse") {
+		if req.Q != "" {
+			queries = append(queries, req.Q)
+		}
+	}
+	return
+}
+
+func TestAdapterAgainstFakeTwitter(t *testing.T) {
+	var (
+		fake = &fakeTwitter{
+			failures: 2,
+			messages: DirectMessageList{
+				{ID: 3, Text: "c", Sender: TwitterUser{ID: 7}},
+				{ID: 1, Text: "a", Sender: TwitterUser{ID: 5}},
+				{ID: 2, Text: "b", Sender: TwitterUser{ID: 7}},
+			},
+		}
+		twitter = httptest.NewServer(fake)
+		store   = &witgo.MemoryCheckpointStore{}
+		cp      witgo.Checkpoint
+		queries []string
+	)
+	defer twitter.Close()
+	if queries = runAdapter(t, twitter, fake, store, 3); len(queries) != 3 || queries[0] != "a" || queries[1] != "b" || queries[2] != "c" {
+		t.Fatalf("Expected the messages in ID order, got %q", queries)
+	}
+	if fake.fetches < 3 {
+		t.Fatalf("Expected failed fetches to be retried, got %v fetches", fake.fetches)
+	}
+	for i, user := range []string{"5", "7", "7"} {
+		if fake.sent[i].Get("user_id") != user || fake.sent[i].Get("text") != "Got it" {
+			t.Errorf("reply %v: got %v, want user %v", i, fake.sent[i], user)
+		}
+	}
+	fake.mu.Lock()
+	fake.messages = append(fake.messages, DirectMessage{ID: 4, Text: "d", Sender: TwitterUser{ID: 5}})
+	fake.sent = nil
+	fake.mu.Unlock()
+	if queries = runAdapter(t, twitter, fake, store, 1); len(queries) != 1 || queries[0] != "d" {
+		t.Fatalf("Expected a restarted adapter to resume after the checkpoint, got %q", queries)
+	}
+	if cp, _ = store.Load(); cp.Position != "4" {
+		t.Fatalf("Expected the checkpoint at 4, got %+v", cp)
+	}
+}
+
+func TestZeroAdapter(t *testing.T) {
+	var adapter Adapter
+	adapter.Stop()
+	select {
+	case <-adapter.Done():
+		t.Fatal("Expected Done to stay open until turns is closed")
+	default:
+	}
+	if id, err := adapter.ProcessedToID(); id != 0 || err != nil {
+		t.Fatalf("Expected no checkpoint, got %v, %v", id, err)
+	}
+	turns := make(chan witgo.Turn)
+	if _, open := <-adapter.Run(turns); open {
+		t.Fatal("Expected a stopped adapter to close records")
+	}
+	close(turns)
+	<-adapter.Done()
+}
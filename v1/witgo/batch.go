@@ -0,0 +1,175 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Configures MessageBatch and MessageStream.
+type BatchOptions struct {
+	// The number of requests made at once.  Defaults to 4.
+	Parallelism int
+	// The number of times a request failing with a retryable error is
+	// retried, see IsRetryable.
+	Retries int
+	// Returns the wait after the given number of failed attempts, starting
+	// at 1.  Defaults to DefaultBackoff.
+	// Rate limit errors wait at least until the limit resets.
+	Backoff func(attempt int) time.Duration
+	// Sent with every request.
+	Message *MessageOptions
+}
+
+// The classification of one text of a batch.  Index is the position of the
+// text in the batch.  Either Response or Err is set.
+type BatchResult struct {
+	Index    int
+	Text     string
+	Response *MessageResponse
+	Err      error
+}
+
+// Classifies texts with the /message endpoint, making several requests at
+// once, and returns the results in the order of texts.  Every text has a
+// result, even if ctx is done.  See MessageStream.
+func (c *Client) MessageBatch(ctx context.Context, texts []string, options *BatchOptions) <-chan BatchResult {
+	var in = make(chan string)
+	go func() {
+		defer close(in)
+		for _, text := range texts {
+			in <- text
+		}
+	}()
+	return c.MessageStream(ctx, in, options)
+}
+
+// Classifies the texts read from in until it is closed, and returns the
+// results in the order the texts were read.  Requests go through the
+// client's RateLimiter and Cache.  A failed text is reported in its result
+// and does not stop the batch.
+//
+// At most twice Parallelism texts are held at once, so the results channel
+// must be drained for the batch to progress.  It is closed once in is closed
+// and every result has been sent.  Once ctx is done, texts in flight and every
+// text read afterwards report ctx's error without making a request, so each
+// text read has a result.
+func (c *Client) MessageStream(ctx context.Context, in <-chan string, options *BatchOptions) <-chan BatchResult {
+	var (
+		opts     BatchOptions
+		out      = make(chan BatchResult)
+		jobs     = make(chan BatchResult)
+		finished = make(chan BatchResult)
+		done     = make(chan struct{})
+		slots    chan struct{}
+	)
+	if options != nil {
+		opts = *options
+	}
+	if opts.Parallelism < 1 {
+		opts.Parallelism = 4
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = DefaultBackoff
+	}
+	slots = make(chan struct{}, 2*opts.Parallelism)
+	go func() {
+		var index int
+		defer close(jobs)
+		for {
+			slots <- struct{}{}
+			text, ok := <-in
+			if !ok {
+				<-slots
+				return
+			}
+			jobs <- BatchResult{Index: index, Text: text, Err: ctx.Err()}
+			index++
+		}
+	}()
+	for i := 0; i < opts.Parallelism; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for job := range jobs {
+				if job.Err == nil {
+					job.Response, job.Err = c.classify(ctx, job.Text, &opts)
+				}
+				finished <- job
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < opts.Parallelism; i++ {
+			<-done
+		}
+		close(finished)
+	}()
+	go func() {
+		var (
+			pending = map[int]BatchResult{}
+			next    int
+			result  BatchResult
+			found   bool
+		)
+		defer close(out)
+		for result = range finished {
+			pending[result.Index] = result
+			for {
+				if result, found = pending[next]; !found {
+					break
+				}
+				delete(pending, next)
+				out <- result
+				<-slots
+				next++
+			}
+		}
+	}()
+	return out
+}
+
+// Classifies a text, retrying retryable errors.
+func (c *Client) classify(ctx context.Context, text string, opts *BatchOptions) (out *MessageResponse, err error) {
+	var (
+		response *Response
+		wait     time.Duration
+		limited  retryAfter
+		timer    *time.Timer
+	)
+	for attempt := 0; ; attempt++ {
+		if response, err = c.MessageWithOptions(ctx, text, opts.Message); err == nil {
+			out = nil
+			if err = response.Parse(&out); err == nil {
+				return
+			}
+		}
+		if attempt >= opts.Retries || !IsRetryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		wait = opts.Backoff(attempt + 1)
+		if errors.As(err, &limited) && limited.RetryAfter() > wait {
+			wait = limited.RetryAfter()
+		}
+		timer = time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
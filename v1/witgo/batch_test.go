@@ -0,0 +1,107 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves /message, echoing q after sleeping for the milliseconds it holds.
+func newEchoServer(calls *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var q = r.URL.Query().Get("q")
+		calls.Add(1)
+		if ms, err := strconv.Atoi(q); err == nil {
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"_text": q})
+	}))
+}
+
+func TestMessageBatchOrder(t *testing.T) {
+	var (
+		calls  atomic.Int64
+		server = newEchoServer(&calls)
+		client = NewClient("token", WithBaseURL(server.URL))
+	)
+	defer server.Close()
+	var tests = []struct {
+		texts       []string
+		parallelism int
+	}{
+		{[]string{"30", "1", "20", "2", "10", "3"}, 3},
+		{[]string{"5", "4", "3", "2", "1"}, 1},
+		{[]string{"1", "10", "1", "10", "1", "10", "1", "10"}, 8},
+		{nil, 2},
+	}
+	for _, test := range tests {
+		var i int
+		for result := range client.MessageBatch(context.Background(), test.texts, &BatchOptions{Parallelism: test.parallelism}) {
+			if result.Err != nil {
+				t.Errorf("%v: result %v: got error %v", test.texts, i, result.Err)
+			} else if result.Index != i || result.Text != test.texts[i] || result.Response.Text != test.texts[i] {
+				t.Errorf("%v: result %v: got index %v text %q response %q", test.texts, i, result.Index, result.Text, result.Response.Text)
+			}
+			i++
+		}
+		if i != len(test.texts) {
+			t.Errorf("%v: got %v results, want %v", test.texts, i, len(test.texts))
+		}
+	}
+}
+
+func TestMessageStreamReportsTextsAfterCancel(t *testing.T) {
+	var (
+		calls       atomic.Int64
+		server      = newEchoServer(&calls)
+		client      = NewClient("token", WithBaseURL(server.URL))
+		ctx, cancel = context.WithCancel(context.Background())
+		in          = make(chan string)
+		results     = client.MessageStream(ctx, in, nil)
+		result      BatchResult
+	)
+	defer server.Close()
+	defer cancel()
+	in <- "first"
+	if result = <-results; result.Err != nil || result.Response.Text != "first" {
+		t.Fatalf("Expected the first text to be classified, got %+v", result)
+	}
+	cancel()
+	go func() {
+		for _, text := range []string{"second", "third"} {
+			in <- text
+		}
+		close(in)
+	}()
+	for i, text := range []string{"second", "third"} {
+		if result = <-results; result.Index != i+1 || result.Text != text || !errors.Is(result.Err, context.Canceled) {
+			t.Errorf("%v: got %+v, want context.Canceled", text, result)
+		}
+	}
+	if _, open := <-results; open {
+		t.Fatal("Expected results to close once in is closed")
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("Expected 1 request, got %v", calls.Load())
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The fields shared by the values of built-in entities such as wit/datetime,
+// wit/duration, wit/number and wit/amount_of_money.
+type builtinValue struct {
+	Type       string          `json:"type"`
+	Value      json.RawMessage `json:"value"`
+	Grain      string          `json:"grain"`
+	Unit       string          `json:"unit"`
+	From       *builtinValue   `json:"from"`
+	To         *builtinValue   `json:"to"`
+	Normalized *builtinValue   `json:"normalized"`
+	Values     []*builtinValue `json:"values"`
+	Resolved   *struct {
+		Values []*ResolvedLocation `json:"values"`
+	} `json:"resolved"`
+}
+
+// Decodes the built-in value of an entity.  Entities built in code rather
+// than decoded have no Raw JSON, so their Value is used.
+func (e *Entity) builtin() (out *builtinValue, err error) {
+	var b []byte
+	out = &builtinValue{}
+	if len(e.Raw) > 0 {
+		err = json.Unmarshal(e.Raw, out)
+		return
+	}
+	if b, err = json.Marshal(e.Value); err != nil {
+		return
+	}
+	out.Type = "value"
+	out.Value = b
+	return
+}
+
+func (v *builtinValue) isInterval() bool {
+	return v.Type == "interval" || (len(v.Value) == 0 && (v.From != nil || v.To != nil))
+}
+
+func (v *builtinValue) number() (out float64, err error) {
+	var s string
+	if len(v.Value) == 0 {
+		err = fmt.Errorf("Entity has no value")
+		return
+	}
+	if err = json.Unmarshal(v.Value, &out); err == nil {
+		return
+	}
+	if err = json.Unmarshal(v.Value, &s); err != nil {
+		return
+	}
+	out, err = strconv.ParseFloat(s, 64)
+	return
+}
+
+// A point in time with the grain it was given at, such as "day" or "hour".
+type DateTimeValue struct {
+	Time  time.Time
+	Grain string
+}
+
+// The value of a wit/datetime entity.  Either the embedded DateTimeValue is
+// set, or Interval is true and From and To are set; an open interval may lack
+// one of them.  Alternatives holds other possible readings of the text.
+type DateTime struct {
+	DateTimeValue
+	Interval     bool
+	From         *DateTimeValue
+	To           *DateTimeValue
+	Alternatives []DateTime
+}
+
+func (v *builtinValue) dateTimeValue() (out *DateTimeValue, err error) {
+	var s string
+	if err = json.Unmarshal(v.Value, &s); err != nil {
+		return
+	}
+	out = &DateTimeValue{Grain: v.Grain}
+	out.Time, err = time.Parse(time.RFC3339, s)
+	return
+}
+
+func (v *builtinValue) dateTime(alternatives bool) (out DateTime, err error) {
+	var value *DateTimeValue
+	if v.isInterval() {
+		out.Interval = true
+		if v.From != nil {
+			if out.From, err = v.From.dateTimeValue(); err != nil {
+				return
+			}
+		}
+		if v.To != nil {
+			if out.To, err = v.To.dateTimeValue(); err != nil {
+				return
+			}
+		}
+	} else {
+		if value, err = v.dateTimeValue(); err != nil {
+			return
+		}
+		out.DateTimeValue = *value
+	}
+	if alternatives {
+		for _, alt := range v.Values {
+			var dt DateTime
+			if dt, err = alt.dateTime(false); err != nil {
+				return
+			}
+			out.Alternatives = append(out.Alternatives, dt)
+		}
+	}
+	return
+}
+
+// Decodes the value of a wit/datetime entity.
+func (e *Entity) DateTime() (out DateTime, err error) {
+	var v *builtinValue
+	if v, err = e.builtin(); err != nil {
+		return
+	}
+	out, err = v.dateTime(true)
+	return
+}
+
+var durationUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// Decodes the value of a wit/duration entity.  Months and years have no
+// fixed length and are only supported through the normalized value.
+func (e *Entity) Duration() (out time.Duration, err error) {
+	var (
+		v      *builtinValue
+		amount float64
+		unit   time.Duration
+		found  bool
+	)
+	if v, err = e.builtin(); err != nil {
+		return
+	}
+	if v.Normalized != nil {
+		v = v.Normalized
+	}
+	if amount, err = v.number(); err != nil {
+		return
+	}
+	if unit, found = durationUnits[v.Unit]; !found {
+		err = fmt.Errorf("Unsupported duration unit %q", v.Unit)
+		return
+	}
+	out = time.Duration(amount * float64(unit))
+	return
+}
+
+// Decodes the value of a wit/number or other numeric entity.
+func (e *Entity) Number() (out float64, err error) {
+	var v *builtinValue
+	if v, err = e.builtin(); err != nil {
+		return
+	}
+	out, err = v.number()
+	return
+}
+
+// The value of a wit/amount_of_money entity.  Either Amount is set, or
+// Interval is true and From and To are set; an open interval may lack one
+// of them.
+type Money struct {
+	Amount   float64
+	Unit     string
+	Interval bool
+	From     *Money
+	To       *Money
+}
+
+func (v *builtinValue) money() (out *Money, err error) {
+	out = &Money{Unit: v.Unit}
+	if !v.isInterval() {
+		out.Amount, err = v.number()
+		return
+	}
+	out.Interval = true
+	if v.From != nil {
+		if out.From, err = v.From.money(); err != nil {
+			return
+		}
+	}
+	if v.To != nil {
+		out.To, err = v.To.money()
+	}
+	return
+}
+
+// Decodes the value of a wit/amount_of_money entity.
+func (e *Entity) Money() (out Money, err error) {
+	var (
+		v     *builtinValue
+		money *Money
+	)
+	if v, err = e.builtin(); err != nil {
+		return
+	}
+	if money, err = v.money(); err != nil {
+		return
+	}
+	out = *money
+	return
+}
+
+type Coords struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+// A place a wit/location entity was resolved to.
+type ResolvedLocation struct {
+	Name     string `json:"name"`
+	Grain    string `json:"grain"`
+	Timezone string `json:"timezone"`
+	Coords   Coords `json:"coords"`
+}
+
+// The value of a wit/location entity: the text of the location and any
+// places it was resolved to.
+type Location struct {
+	Name     string
+	Resolved []*ResolvedLocation
+}
+
+// Decodes the value of a wit/location entity.
+func (e *Entity) Location() (out Location, err error) {
+	var v *builtinValue
+	if v, err = e.builtin(); err != nil {
+		return
+	}
+	out.Name = rawString(v.Value)
+	if v.Resolved != nil {
+		out.Resolved = v.Resolved.Values
+	}
+	return
+}
+
+// Decodes the first entity for key as a wit/datetime.
+func (m EntityMap) DateTime(key string) (out DateTime, err error) {
+	var entity *Entity
+	if entity, err = m.FirstEntity(key); err != nil {
+		return
+	}
+	return entity.DateTime()
+}
+
+// Decodes the first entity for key as a wit/duration.
+func (m EntityMap) Duration(key string) (out time.Duration, err error) {
+	var entity *Entity
+	if entity, err = m.FirstEntity(key); err != nil {
+		return
+	}
+	return entity.Duration()
+}
+
+// Decodes the first entity for key as a number.
+func (m EntityMap) Number(key string) (out float64, err error) {
+	var entity *Entity
+	if entity, err = m.FirstEntity(key); err != nil {
+		return
+	}
+	return entity.Number()
+}
+
+// Decodes the first entity for key as a wit/amount_of_money.
+func (m EntityMap) Money(key string) (out Money, err error) {
+	var entity *Entity
+	if entity, err = m.FirstEntity(key); err != nil {
+		return
+	}
+	return entity.Money()
+}
+
+// Decodes the first entity for key as a wit/location.
+func (m EntityMap) Location(key string) (out Location, err error) {
+	var entity *Entity
+	if entity, err = m.FirstEntity(key); err != nil {
+		return
+	}
+	return entity.Location()
+}
@@ -0,0 +1,240 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeEntity(t *testing.T, raw string) (e *Entity) {
+	e = &Entity{}
+	if err := json.Unmarshal([]byte(raw), e); err != nil {
+		t.Fatalf("Decoding %v: %v", raw, err)
+	}
+	return
+}
+
+func formatDateTimeValue(v *DateTimeValue) string {
+	if v == nil {
+		return "-"
+	}
+	return v.Time.UTC().Format(time.RFC3339) + "/" + v.Grain
+}
+
+// Formats a DateTime as "time/grain", "from..to" for intervals and
+// alternatives in brackets.
+func formatDateTime(dt DateTime) (out string) {
+	var alternatives []string
+	if dt.Interval {
+		out = formatDateTimeValue(dt.From) + ".." + formatDateTimeValue(dt.To)
+	} else {
+		out = formatDateTimeValue(&dt.DateTimeValue)
+	}
+	for _, alt := range dt.Alternatives {
+		alternatives = append(alternatives, formatDateTime(alt))
+	}
+	if len(alternatives) > 0 {
+		out += " [" + strings.Join(alternatives, ", ") + "]"
+	}
+	return
+}
+
+func TestEntityDateTime(t *testing.T) {
+	var tests = []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "value",
+			raw:  `{"type": "value", "value": "2016-05-04T10:00:00.000-07:00", "grain": "hour"}`,
+			want: "2016-05-04T17:00:00Z/hour",
+		},
+		{
+			name: "interval",
+			raw: `{"type": "interval",
+				"from": {"value": "2016-05-04T18:00:00.000-07:00", "grain": "hour"},
+				"to": {"value": "2016-05-05T00:00:00.000-07:00", "grain": "hour"}}`,
+			want: "2016-05-05T01:00:00Z/hour..2016-05-05T07:00:00Z/hour",
+		},
+		{
+			name: "open interval",
+			raw:  `{"type": "interval", "from": {"value": "2016-05-04T00:00:00.000Z", "grain": "day"}}`,
+			want: "2016-05-04T00:00:00Z/day..-",
+		},
+		{
+			name: "alternatives",
+			raw: `{"type": "value", "value": "2016-05-06T00:00:00.000Z", "grain": "day", "values": [
+				{"type": "value", "value": "2016-05-06T00:00:00.000Z", "grain": "day"},
+				{"type": "interval", "from": {"value": "2016-05-13T00:00:00.000Z", "grain": "day"}}]}`,
+			want: "2016-05-06T00:00:00Z/day [2016-05-06T00:00:00Z/day, 2016-05-13T00:00:00Z/day..-]",
+		},
+		{
+			name: "not a time",
+			raw:  `{"type": "value", "value": "tomorrow"}`,
+			want: "error",
+		},
+	}
+	for _, test := range tests {
+		var (
+			dt, err = decodeEntity(t, test.raw).DateTime()
+			got     = formatDateTime(dt)
+		)
+		if err != nil {
+			got = "error"
+		}
+		if got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEntityDuration(t *testing.T) {
+	var tests = []struct {
+		name string
+		raw  string
+		want time.Duration
+		err  bool
+	}{
+		{name: "seconds", raw: `{"value": 30, "unit": "second"}`, want: 30 * time.Second},
+		{name: "fractional", raw: `{"value": 1.5, "unit": "hour"}`, want: 90 * time.Minute},
+		{name: "string amount", raw: `{"value": "2", "unit": "day"}`, want: 48 * time.Hour},
+		{
+			name: "normalized",
+			raw:  `{"value": 2, "unit": "week", "normalized": {"value": 1209600, "unit": "second"}}`,
+			want: 14 * 24 * time.Hour,
+		},
+		{
+			name: "month through normalized",
+			raw:  `{"value": 1, "unit": "month", "normalized": {"value": 2592000, "unit": "second"}}`,
+			want: 30 * 24 * time.Hour,
+		},
+		{name: "month", raw: `{"value": 1, "unit": "month"}`, err: true},
+		{name: "no value", raw: `{"unit": "second"}`, err: true},
+	}
+	for _, test := range tests {
+		var got, err = decodeEntity(t, test.raw).Duration()
+		if (err != nil) != test.err {
+			t.Errorf("%v: got error %v, want error %v", test.name, err, test.err)
+		} else if got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEntityNumber(t *testing.T) {
+	var tests = []struct {
+		name   string
+		entity *Entity
+		want   float64
+		err    bool
+	}{
+		{name: "number", entity: decodeEntity(t, `{"type": "value", "value": 42}`), want: 42},
+		{name: "string", entity: decodeEntity(t, `{"type": "value", "value": "3.5"}`), want: 3.5},
+		{name: "built in code", entity: &Entity{Value: "7"}, want: 7},
+		{name: "text", entity: decodeEntity(t, `{"type": "value", "value": "many"}`), err: true},
+	}
+	for _, test := range tests {
+		var got, err = test.entity.Number()
+		if (err != nil) != test.err {
+			t.Errorf("%v: got error %v, want error %v", test.name, err, test.err)
+		} else if got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func formatMoney(m *Money) string {
+	if m == nil {
+		return "-"
+	}
+	if m.Interval {
+		return formatMoney(m.From) + ".." + formatMoney(m.To)
+	}
+	return fmt.Sprintf("%v %v", m.Amount, m.Unit)
+}
+
+func TestEntityMoney(t *testing.T) {
+	var tests = []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "value", raw: `{"type": "value", "value": 10.5, "unit": "$"}`, want: "10.5 $"},
+		{
+			name: "interval",
+			raw:  `{"type": "interval", "from": {"value": 10, "unit": "EUR"}, "to": {"value": 20, "unit": "EUR"}}`,
+			want: "10 EUR..20 EUR",
+		},
+		{name: "open interval", raw: `{"type": "interval", "to": {"value": 5, "unit": "$"}}`, want: "-..5 $"},
+	}
+	for _, test := range tests {
+		var money, err = decodeEntity(t, test.raw).Money()
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		} else if got := formatMoney(&money); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEntityLocation(t *testing.T) {
+	var tests = []struct {
+		name string
+		raw  string
+		want Location
+	}{
+		{name: "unresolved", raw: `{"value": "Paris"}`, want: Location{Name: "Paris"}},
+		{
+			name: "resolved",
+			raw: `{"value": "Paris", "resolved": {"values": [{"name": "Paris", "grain": "locality",
+				"timezone": "Europe/Paris", "coords": {"lat": 48.85, "long": 2.35}}]}}`,
+			want: Location{Name: "Paris", Resolved: []*ResolvedLocation{{
+				Name:     "Paris",
+				Grain:    "locality",
+				Timezone: "Europe/Paris",
+				Coords:   Coords{Lat: 48.85, Long: 2.35},
+			}}},
+		},
+	}
+	for _, test := range tests {
+		var got, err = decodeEntity(t, test.raw).Location()
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %+v and %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestEntityMapBuiltins(t *testing.T) {
+	var (
+		entities EntityMap
+		number   float64
+		err      error
+	)
+	if err = json.Unmarshal([]byte(`{"number": [{"value": 3}, {"value": 4}]}`), &entities); err != nil {
+		t.Fatal(err)
+	}
+	if number, err = entities.Number("number"); err != nil || number != 3 {
+		t.Errorf("got %v and %v, want the first entity", number, err)
+	}
+	if _, err = entities.Number("missing"); err == nil {
+		t.Errorf("Expected an error for a missing entity")
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A response stored by a MessageCache.  Body is stored decoded.
+type CacheEntry struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	Expires    time.Time   `json:"expires"`
+}
+
+func (e *CacheEntry) expired() bool {
+	return !e.Expires.IsZero() && time.Now().After(e.Expires)
+}
+
+func (e *CacheEntry) response(request *http.Request) *Response {
+	return &Response{
+		Status:     fmt.Sprintf("%v %v", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode: e.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     e.Header.Clone(),
+		Body:       ioutil.NopCloser(bytes.NewReader(e.Body)),
+		Request:    request,
+	}
+}
+
+// Stores responses to Client.Message.  Implementations set Expires on the
+// entries they store and must be safe for concurrent use.
+type MessageCache interface {
+	Get(key string) (entry *CacheEntry, found bool)
+	Set(key string, entry *CacheEntry) (err error)
+}
+
+// Keeps up to Capacity entries in memory for TTL, evicting the least
+// recently used entry when full.  A zero TTL keeps entries until evicted.
+type MemoryCache struct {
+	Capacity int
+	TTL      time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+func NewMemoryCache(capacity int, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		Capacity: capacity,
+		TTL:      ttl,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (c *MemoryCache) Get(key string) (entry *CacheEntry, found bool) {
+	var element *list.Element
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, found = c.entries[key]; !found {
+		return
+	}
+	if entry = element.Value.(*memoryCacheItem).entry; entry.expired() {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return
+}
+
+func (c *MemoryCache) Set(key string, entry *CacheEntry) error {
+	var (
+		element *list.Element
+		found   bool
+	)
+	if c.TTL > 0 {
+		entry.Expires = time.Now().Add(c.TTL)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, found = c.entries[key]; found {
+		element.Value.(*memoryCacheItem).entry = entry
+		c.order.MoveToFront(element)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheItem{key: key, entry: entry})
+	for c.Capacity > 0 && c.order.Len() > c.Capacity {
+		element = c.order.Back()
+		c.order.Remove(element)
+		delete(c.entries, element.Value.(*memoryCacheItem).key)
+	}
+	return nil
+}
+
+// Stores each entry as a JSON file in Dir for TTL.  A zero TTL keeps entries
+// forever.  Expired files are removed when read and whenever an entry is
+// stored.
+type FileCache struct {
+	Dir string
+	TTL time.Duration
+	// The number of files kept, removing the least recently used when more
+	// are stored.  Zero keeps every file.
+	MaxEntries int
+}
+
+// Creates a file cache, creating dir if needed and removing expired files.
+func NewFileCache(dir string, ttl time.Duration) (c *FileCache, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	c = &FileCache{Dir: dir, TTL: ttl}
+	err = c.prune()
+	return
+}
+
+func (c *FileCache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// Returns the entry stored for key and marks its file as used.
+func (c *FileCache) Get(key string) (entry *CacheEntry, found bool) {
+	var (
+		b   []byte
+		now = time.Now()
+		err error
+	)
+	if b, err = ioutil.ReadFile(c.path(key)); err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &entry); err != nil || entry.expired() {
+		os.Remove(c.path(key))
+		return nil, false
+	}
+	os.Chtimes(c.path(key), now, now)
+	found = true
+	return
+}
+
+// Writes to a temporary file first so a crash never leaves a partial file.
+func (c *FileCache) Set(key string, entry *CacheEntry) (err error) {
+	var (
+		b   []byte
+		tmp *os.File
+	)
+	if c.TTL > 0 {
+		entry.Expires = time.Now().Add(c.TTL)
+	}
+	if b, err = json.Marshal(entry); err != nil {
+		return
+	}
+	if tmp, err = os.CreateTemp(c.Dir, key+".*.tmp"); err != nil {
+		return
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err = os.Rename(tmp.Name(), c.path(key)); err != nil {
+		return
+	}
+	return c.prune()
+}
+
+// Removes expired files, then the least recently used files beyond
+// MaxEntries.  Files are aged by their modification time, which is when they
+// were last stored or read, so a file read shortly before it expired is
+// only removed once Get reads it again or it ages past TTL.
+func (c *FileCache) prune() (err error) {
+	var (
+		entries []os.DirEntry
+		files   []os.FileInfo
+		info    os.FileInfo
+		now     = time.Now()
+	)
+	if c.TTL <= 0 && c.MaxEntries <= 0 {
+		return
+	}
+	if entries, err = os.ReadDir(c.Dir); err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		if info, err = entry.Info(); err != nil {
+			err = nil
+			continue
+		}
+		if c.TTL > 0 && now.Sub(info.ModTime()) > c.TTL {
+			os.Remove(filepath.Join(c.Dir, info.Name()))
+			continue
+		}
+		files = append(files, info)
+	}
+	if c.MaxEntries <= 0 || len(files) <= c.MaxEntries {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, info = range files[:len(files)-c.MaxEntries] {
+		os.Remove(filepath.Join(c.Dir, info.Name()))
+	}
+	return
+}
+
+// Counts the lookups of a Client's MessageCache.  Shared counts requests
+// which waited for an identical request already in flight.
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	Shared int64
+}
+
+type cacheCounters struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+	shared atomic.Int64
+}
+
+// A request to the API shared by identical concurrent requests.
+type inflightCall struct {
+	done  chan struct{}
+	entry *CacheEntry
+	err   error
+}
+
+// Returns the cache statistics of the client.
+func (c *Client) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   c.cacheCounters.hits.Load(),
+		Misses: c.cacheCounters.misses.Load(),
+		Shared: c.cacheCounters.shared.Load(),
+	}
+}
+
+// Normalizes text so that utterances differing only in case and spacing
+// share a cache entry.
+func normalizeQuery(q string) string {
+	return strings.Join(strings.Fields(strings.ToLower(q)), " ")
+}
+
+// Returns the cache key of a request: a hash of the app, the endpoint and
+// every parameter, including the API version, with q normalized.
+func (c *Client) cacheKey(request *http.Request) string {
+	var (
+		query = request.URL.Query()
+		hash  = sha256.New()
+	)
+	query.Set("q", normalizeQuery(query.Get("q")))
+	fmt.Fprintf(hash, "%v\n%v\n%v\n%v\n%v", c.ServerAccessToken, request.URL.Host, request.URL.Path, c.Version, query.Encode())
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Serves a request from the cache, or makes it and caches successful
+// responses.  Identical requests made while one is in flight wait for it
+// instead of calling the API.  The shared request is not canceled with the
+// context of the request which started it, so each caller only stops waiting
+// when its own context is done.
+func (c *Client) makeCachedRequest(request *http.Request) (response *Response, err error) {
+	var (
+		key   = c.cacheKey(request)
+		ctx   = request.Context()
+		entry *CacheEntry
+		call  *inflightCall
+		found bool
+	)
+	if entry, found = c.Cache.Get(key); found {
+		c.cacheCounters.hits.Add(1)
+		if c.Logger != nil {
+			c.Logger.LogAttrs(request.Context(), slog.LevelDebug, "wit.ai cache hit", slog.String("endpoint", request.URL.Path))
+		}
+		return entry.response(request), nil
+	}
+	c.cacheMu.Lock()
+	if call, found = c.inflight[key]; found {
+		c.cacheCounters.shared.Add(1)
+	} else {
+		call = &inflightCall{done: make(chan struct{})}
+		if c.inflight == nil {
+			c.inflight = map[string]*inflightCall{}
+		}
+		c.inflight[key] = call
+		c.cacheCounters.misses.Add(1)
+		go c.fetchShared(key, call, request.WithContext(context.WithoutCancel(ctx)))
+	}
+	c.cacheMu.Unlock()
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.entry.response(request), nil
+}
+
+// Makes the request shared by call and caches a successful response.
+func (c *Client) fetchShared(key string, call *inflightCall, request *http.Request) {
+	var err error
+	defer func() {
+		c.cacheMu.Lock()
+		delete(c.inflight, key)
+		c.cacheMu.Unlock()
+		close(call.done)
+	}()
+	if call.entry, call.err = c.fetchEntry(request); call.err != nil {
+		return
+	}
+	if call.entry.StatusCode >= 200 && call.entry.StatusCode <= 299 {
+		if err = c.Cache.Set(key, call.entry); err != nil && c.Logger != nil {
+			c.Logger.LogAttrs(request.Context(), slog.LevelWarn, "wit.ai cache write failed", slog.Any("error", err))
+		}
+	}
+}
+
+// Makes a request and reads its response into a cache entry.
+func (c *Client) fetchEntry(request *http.Request) (entry *CacheEntry, err error) {
+	var response *Response
+	if response, err = c.makeRequest(request); err != nil {
+		return
+	}
+	defer response.Body.Close()
+	entry = &CacheEntry{StatusCode: response.StatusCode, Header: response.Header.Clone()}
+	if entry.Body, err = response.readBody(); err != nil {
+		return nil, err
+	}
+	entry.Header.Del("Content-Encoding")
+	entry.Header.Del("Content-Length")
+	return
+}
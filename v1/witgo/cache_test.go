@@ -0,0 +1,252 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	var (
+		client = NewClient("token")
+		other  = NewClient("other")
+		older  = NewClient("token", WithAPIVersion("20160516"))
+	)
+	key := func(c *Client, path string, fields map[string]string) string {
+		request, err := c.buildGetRequest(context.Background(), path, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.cacheKey(request)
+	}
+	var base = key(client, "/message", map[string]string{"q": "Hello world"})
+	var tests = []struct {
+		name   string
+		client *Client
+		path   string
+		fields map[string]string
+		same   bool
+	}{
+		{"identical", client, "/message", map[string]string{"q": "Hello world"}, true},
+		{"case and spacing", client, "/message", map[string]string{"q": "  hello   WORLD "}, true},
+		{"empty parameter", client, "/message", map[string]string{"q": "Hello world", "tag": ""}, true},
+		{"other text", client, "/message", map[string]string{"q": "Hello there"}, false},
+		{"parameter", client, "/message", map[string]string{"q": "Hello world", "n": "2"}, false},
+		{"tag", client, "/message", map[string]string{"q": "Hello world", "tag": "prod"}, false},
+		{"endpoint", client, "/speech", map[string]string{"q": "Hello world"}, false},
+		{"app", other, "/message", map[string]string{"q": "Hello world"}, false},
+		{"version", older, "/message", map[string]string{"q": "Hello world"}, false},
+	}
+	for _, test := range tests {
+		if got := key(test.client, test.path, test.fields) == base; got != test.same {
+			t.Errorf("%v: got same key %v, want %v", test.name, got, test.same)
+		}
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	var (
+		cache = NewMemoryCache(2, 0)
+		found bool
+	)
+	cache.Set("a", &CacheEntry{StatusCode: 200})
+	cache.Set("b", &CacheEntry{StatusCode: 200})
+	cache.Get("a")
+	cache.Set("c", &CacheEntry{StatusCode: 200})
+	var tests = []struct {
+		key  string
+		want bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	}
+	for _, test := range tests {
+		if _, found = cache.Get(test.key); found != test.want {
+			t.Errorf("%v: got found %v, want %v", test.key, found, test.want)
+		}
+	}
+	cache = NewMemoryCache(0, time.Millisecond)
+	cache.Set("a", &CacheEntry{StatusCode: 200})
+	time.Sleep(5 * time.Millisecond)
+	if _, found = cache.Get("a"); found {
+		t.Errorf("Expected the entry to expire")
+	}
+}
+
+func TestSharedRequestSurvivesLeaderCancel(t *testing.T) {
+	var (
+		calls       atomic.Int64
+		started     = make(chan struct{})
+		release     = make(chan struct{})
+		server      *httptest.Server
+		client      *Client
+		ctx, cancel = context.WithCancel(context.Background())
+		leaderErr   = make(chan error, 1)
+		waiterErr   = make(chan error, 1)
+		response    *Response
+		err         error
+	)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		fmt.Fprint(w, `{"msg_id": "1", "_text": "hi"}`)
+	}))
+	defer server.Close()
+	client = NewClient("token", WithBaseURL(server.URL), WithCache(NewMemoryCache(10, 0)))
+	go func() {
+		_, err := client.MessageContext(ctx, "hi")
+		leaderErr <- err
+	}()
+	<-started
+	go func() {
+		if response, err := client.Message("hi"); err != nil {
+			waiterErr <- err
+		} else {
+			response.Body.Close()
+			waiterErr <- nil
+		}
+	}()
+	for client.CacheStats().Shared == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err = <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the leader to be canceled, got %v", err)
+	}
+	close(release)
+	if err = <-waiterErr; err != nil {
+		t.Fatalf("Expected the waiter to get the shared response, got %v", err)
+	}
+	if response, err = client.Message("hi"); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if calls.Load() != 1 || client.CacheStats().Hits != 1 {
+		t.Fatalf("Expected 1 API call and 1 cache hit, got %v and %+v", calls.Load(), client.CacheStats())
+	}
+}
+
+func TestFileCacheMaxEntries(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		cache *FileCache
+		found bool
+		err   error
+	)
+	if cache, err = NewFileCache(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	cache.MaxEntries = 2
+	for i, key := range []string{"a", "b", "c"} {
+		if err = cache.Set(key, &CacheEntry{StatusCode: 200}); err != nil {
+			t.Fatal(err)
+		}
+		stored := time.Now().Add(time.Duration(i-3) * time.Minute)
+		if err = os.Chtimes(cache.path(key), stored, stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		key  string
+		want bool
+	}{
+		{"a", false},
+		{"b", true},
+		{"c", true},
+	}
+	for _, test := range tests {
+		if _, found = cache.Get(test.key); found != test.want {
+			t.Errorf("%v: got found %v, want %v", test.key, found, test.want)
+		}
+	}
+}
+
+func TestFileCachePrunesExpiredFiles(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		cache *FileCache
+		old   = time.Now().Add(-2 * time.Hour)
+		err   error
+	)
+	if cache, err = NewFileCache(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Set("old", &CacheEntry{StatusCode: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(cache.path("old"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Set("new", &CacheEntry{StatusCode: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(cache.path("old")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the expired file to be removed, got %v", err)
+	}
+	if _, err = os.Stat(cache.path("new")); err != nil {
+		t.Fatalf("Expected the new file to be kept, got %v", err)
+	}
+}
+
+func TestFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var (
+		cache *FileCache
+		found bool
+		err   error
+	)
+	if cache, err = NewFileCache(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+	cache.MaxEntries = 2
+	for i, key := range []string{"a", "b"} {
+		if err = cache.Set(key, &CacheEntry{StatusCode: 200}); err != nil {
+			t.Fatal(err)
+		}
+		stored := time.Now().Add(time.Duration(i-3) * time.Minute)
+		if err = os.Chtimes(cache.path(key), stored, stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, found = cache.Get("a"); !found {
+		t.Fatalf("Expected a to be found")
+	}
+	if err = cache.Set("c", &CacheEntry{StatusCode: 200}); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		key  string
+		want bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	}
+	for _, test := range tests {
+		if _, found = cache.Get(test.key); found != test.want {
+			t.Errorf("%v: got found %v, want %v", test.key, found, test.want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+// A recorded HTTP request.  The Authorization header is never recorded.
+type CassetteRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  string      `json:"query"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	Base64 bool        `json:"base64,omitempty"`
+}
+
+// A recorded HTTP response.
+type CassetteResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	Base64     bool        `json:"base64,omitempty"`
+}
+
+type Interaction struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+// A list of recorded interactions, stored as JSON.
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+func LoadCassette(path string) (cassette *Cassette, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	cassette = &Cassette{}
+	if err = json.Unmarshal(b, cassette); err != nil {
+		cassette = nil
+	}
+	return
+}
+
+func (c *Cassette) Save(path string) (err error) {
+	var (
+		buf     = &bytes.Buffer{}
+		encoder = json.NewEncoder(buf)
+		tmp     = path + ".tmp"
+	)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(c); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return
+	}
+	err = os.Rename(tmp, path)
+	return
+}
+
+func encodeCassetteBody(b []byte) (body string, isBase64 bool) {
+	if utf8.Valid(b) {
+		return string(b), false
+	}
+	return base64.StdEncoding.EncodeToString(b), true
+}
+
+func decodeCassetteBody(body string, isBase64 bool) (b []byte, err error) {
+	if !isBase64 {
+		return []byte(body), nil
+	}
+	return base64.StdEncoding.DecodeString(body)
+}
+
+// Reads a request body and replaces it so the request can still be sent.
+func readRequestBody(req *http.Request) (b []byte, err error) {
+	if req.Body == nil {
+		return
+	}
+	if b, err = ioutil.ReadAll(req.Body); err != nil {
+		return
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return
+}
+
+// Sends requests through another HttpClient and appends every request and
+// response to a cassette file, which is rewritten after each interaction.
+type RecordingHttpClient struct {
+	path     string
+	client   HttpClient
+	mu       sync.Mutex
+	cassette *Cassette
+}
+
+func NewRecordingHttpClient(path string, client HttpClient) *RecordingHttpClient {
+	return &RecordingHttpClient{
+		path:     path,
+		client:   client,
+		cassette: &Cassette{},
+	}
+}
+
+func (c *RecordingHttpClient) Do(req *http.Request) (resp *http.Response, err error) {
+	var (
+		reqBody  []byte
+		respBody []byte
+		header   http.Header
+		record   = &Interaction{}
+	)
+	if reqBody, err = readRequestBody(req); err != nil {
+		return
+	}
+	if resp, err = c.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if respBody, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	header = req.Header.Clone()
+	header.Del("Authorization")
+	record.Request = CassetteRequest{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.Query().Encode(),
+		Header: header,
+	}
+	record.Request.Body, record.Request.Base64 = encodeCassetteBody(reqBody)
+	record.Response = CassetteResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+	}
+	record.Response.Body, record.Response.Base64 = encodeCassetteBody(respBody)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cassette.Interactions = append(c.cassette.Interactions, record)
+	err = c.cassette.Save(c.path)
+	return
+}
+
+// Returned by ReplayingHttpClient when no recorded interaction matches.
+type CassetteMissError struct {
+	Method string
+	URL    string
+}
+
+func (e CassetteMissError) Error() string {
+	return fmt.Sprintf("No recorded interaction for %v %v", e.Method, e.URL)
+}
+
+// Serves responses from a cassette instead of sending requests.  A request
+// matches an interaction with the same method, path, query and body; headers,
+// including Authorization, are ignored.  Each interaction is served once, in
+// the order recorded.
+type ReplayingHttpClient struct {
+	mu       sync.Mutex
+	cassette *Cassette
+	used     []bool
+}
+
+func NewReplayingHttpClient(path string) (client *ReplayingHttpClient, err error) {
+	var cassette *Cassette
+	if cassette, err = LoadCassette(path); err != nil {
+		return
+	}
+	client = &ReplayingHttpClient{
+		cassette: cassette,
+		used:     make([]bool, len(cassette.Interactions)),
+	}
+	return
+}
+
+// Compares bodies as JSON when both parse, so key order does not matter.
+func sameBody(a []byte, b []byte) bool {
+	var (
+		av, bv interface{}
+		ab, bb []byte
+	)
+	if bytes.Equal(a, b) {
+		return true
+	}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return false
+	}
+	ab, _ = json.Marshal(av)
+	bb, _ = json.Marshal(bv)
+	return bytes.Equal(ab, bb)
+}
+
+func sameQuery(a string, b string) bool {
+	var (
+		av, bv url.Values
+		err    error
+	)
+	if av, err = url.ParseQuery(a); err != nil {
+		return a == b
+	}
+	if bv, err = url.ParseQuery(b); err != nil {
+		return a == b
+	}
+	return av.Encode() == bv.Encode()
+}
+
+func (c *ReplayingHttpClient) Do(req *http.Request) (resp *http.Response, err error) {
+	var (
+		reqBody  []byte
+		recBody  []byte
+		respBody []byte
+		record   *Interaction
+		i        int
+	)
+	if reqBody, err = readRequestBody(req); err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, record = range c.cassette.Interactions {
+		if c.used[i] || record.Request.Method != req.Method || record.Request.Path != req.URL.Path {
+			continue
+		}
+		if !sameQuery(record.Request.Query, req.URL.RawQuery) {
+			continue
+		}
+		if recBody, err = decodeCassetteBody(record.Request.Body, record.Request.Base64); err != nil {
+			return
+		}
+		if !sameBody(recBody, reqBody) {
+			continue
+		}
+		if respBody, err = decodeCassetteBody(record.Response.Body, record.Response.Base64); err != nil {
+			return
+		}
+		c.used[i] = true
+		resp = &http.Response{
+			Status:        fmt.Sprintf("%d %v", record.Response.StatusCode, http.StatusText(record.Response.StatusCode)),
+			StatusCode:    record.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        record.Response.Header.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(respBody)),
+			ContentLength: int64(len(respBody)),
+			Request:       req,
+		}
+		if resp.Header == nil {
+			resp.Header = http.Header{}
+		}
+		return
+	}
+	err = CassetteMissError{Method: req.Method, URL: req.URL.String()}
+	return
+}
+
+// Returns the interactions which have not been served yet.
+func (c *ReplayingHttpClient) Unused() (out []*Interaction) {
+	var (
+		record *Interaction
+		i      int
+	)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, record = range c.cassette.Interactions {
+		if !c.used[i] {
+			out = append(out, record)
+		}
+	}
+	return
+}
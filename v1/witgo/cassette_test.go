@@ -0,0 +1,119 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassetteRecordAndReplay(t *testing.T) {
+	var (
+		path   = filepath.Join(t.TempDir(), "cassette.json")
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]string{"_text": r.URL.Query().Get("q")})
+		}))
+		recorder  *RecordingHttpClient
+		replayer  *ReplayingHttpClient
+		client    *Client
+		response  *Response
+		parsed    *MessageResponse
+		data      []byte
+		missError CassetteMissError
+		err       error
+	)
+	defer server.Close()
+	recorder = NewRecordingHttpClient(path, http.DefaultClient)
+	client = NewClient("secret-token", WithBaseURL(server.URL), WithHttpClient(recorder))
+	for _, q := range []string{"hello", "goodbye"} {
+		if response, err = client.Message(q); err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+	if data, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-token") {
+		t.Fatalf("Expected the token not to be recorded, got %s", data)
+	}
+	server.Close()
+	if replayer, err = NewReplayingHttpClient(path); err != nil {
+		t.Fatal(err)
+	}
+	client = NewClient("other-token", WithBaseURL(server.URL), WithHttpClient(replayer))
+	var tests = []struct {
+		q    string
+		miss bool
+	}{
+		{"goodbye", false},
+		{"hello", false},
+		{"hello", true},
+		{"unknown", true},
+	}
+	for _, test := range tests {
+		response, err = client.Message(test.q)
+		if test.miss {
+			if !errors.As(err, &missError) {
+				t.Errorf("%v: got error %v, want a CassetteMissError", test.q, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: got error %v", test.q, err)
+			continue
+		}
+		parsed = nil
+		if err = response.Parse(&parsed); err != nil || parsed.Text != test.q {
+			t.Errorf("%v: got %+v and error %v", test.q, parsed, err)
+		}
+	}
+	if unused := replayer.Unused(); len(unused) != 0 {
+		t.Errorf("Expected every interaction to be replayed, got %v unused", len(unused))
+	}
+}
+
+func TestCassetteBodies(t *testing.T) {
+	var tests = []struct {
+		name   string
+		body   []byte
+		base64 bool
+	}{
+		{"text", []byte(`{"q": "hi"}`), false},
+		{"empty", nil, false},
+		{"binary", []byte{0xff, 0xfe, 0x00}, true},
+	}
+	for _, test := range tests {
+		body, isBase64 := encodeCassetteBody(test.body)
+		if isBase64 != test.base64 {
+			t.Errorf("%v: got base64 %v, want %v", test.name, isBase64, test.base64)
+		}
+		if decoded, err := decodeCassetteBody(body, isBase64); err != nil || string(decoded) != string(test.body) {
+			t.Errorf("%v: got %q and error %v, want %q", test.name, decoded, err, test.body)
+		}
+	}
+	if !sameBody([]byte(`{"a": 1, "b": 2}`), []byte(`{"b":2,"a":1}`)) || sameBody([]byte(`{"a": 1}`), []byte(`{"a": 2}`)) {
+		t.Errorf("Expected JSON bodies to be compared ignoring key order")
+	}
+	if !sameQuery("a=1&b=2", "b=2&a=1") || sameQuery("a=1", "a=2") {
+		t.Errorf("Expected queries to be compared ignoring parameter order")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Records how far an Input has been processed.
+// Seen holds the IDs of the most recently committed records, oldest first.
+type Checkpoint struct {
+	Position string   `json:"position"`
+	Seen     []string `json:"seen,omitempty"`
+}
+
+// Persists a Checkpoint between runs.
+type CheckpointStore interface {
+	Load() (cp Checkpoint, err error)
+	Save(cp Checkpoint) (err error)
+}
+
+// Keeps a checkpoint in memory only.
+type MemoryCheckpointStore struct {
+	mu sync.Mutex
+	cp Checkpoint
+}
+
+func (s *MemoryCheckpointStore) Load() (Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cp, nil
+}
+
+func (s *MemoryCheckpointStore) Save(cp Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cp = cp
+	return nil
+}
+
+// Keeps a checkpoint in a JSON file.  A missing file loads as an empty
+// checkpoint.
+type FileCheckpointStore struct {
+	Path string
+}
+
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{Path: path}
+}
+
+func (s *FileCheckpointStore) Load() (cp Checkpoint, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(s.Path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(b, &cp)
+	return
+}
+
+// Writes to a temporary file first so a crash never leaves a partial file.
+func (s *FileCheckpointStore) Save(cp Checkpoint) (err error) {
+	var (
+		b   []byte
+		tmp = s.Path + ".tmp"
+	)
+	if b, err = json.Marshal(cp); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return
+	}
+	err = os.Rename(tmp, s.Path)
+	return
+}
+
+// Tracks the checkpoint of an Input.  Witgo commits each record once its turn
+// has finished, so a restarted Input resuming from Position may read some
+// records again; those are recognized by ID and skipped.
+type Checkpointer struct {
+	// Number of record IDs remembered for deduplication.
+	MaxSeen int
+
+	store CheckpointStore
+	mu    sync.Mutex
+	cp    Checkpoint
+	seen  map[string]bool
+}
+
+// Creates a Checkpointer, loading the last checkpoint from store.
+func NewCheckpointer(store CheckpointStore) (c *Checkpointer, err error) {
+	var id string
+	c = &Checkpointer{
+		MaxSeen: 1000,
+		store:   store,
+		seen:    map[string]bool{},
+	}
+	if c.cp, err = store.Load(); err != nil {
+		c = nil
+		return
+	}
+	for _, id = range c.cp.Seen {
+		c.seen[id] = true
+	}
+	return
+}
+
+// Returns the position of the last committed record.
+func (c *Checkpointer) Position() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cp.Position
+}
+
+// Returns true if a record with the supplied ID was committed recently.
+func (c *Checkpointer) Seen(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seen[id]
+}
+
+// Moves the position without recording a record, for example to skip a
+// backlog.
+func (c *Checkpointer) Reset(position string) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cp.Position = position
+	err = c.store.Save(c.cp)
+	return
+}
+
+// Records that a record has been processed and saves the checkpoint.
+// Records without a Position leave the position unchanged.
+func (c *Checkpointer) Commit(record InputRecord) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if record.Position != "" {
+		c.cp.Position = record.Position
+	}
+	if record.ID != "" && !c.seen[record.ID] {
+		c.seen[record.ID] = true
+		c.cp.Seen = append(c.cp.Seen, record.ID)
+		for len(c.cp.Seen) > c.MaxSeen {
+			delete(c.seen, c.cp.Seen[0])
+			c.cp.Seen = c.cp.Seen[1:]
+		}
+	}
+	err = c.store.Save(c.cp)
+	return
+}
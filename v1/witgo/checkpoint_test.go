@@ -0,0 +1,86 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	var (
+		store = NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+		want  = Checkpoint{Position: "3", Seen: []string{"2", "3"}}
+		cp    Checkpoint
+		err   error
+	)
+	if cp, err = store.Load(); err != nil || !reflect.DeepEqual(cp, Checkpoint{}) {
+		t.Fatalf("Expected a missing file to load as empty, got %+v and %v", cp, err)
+	}
+	if err = store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err = store.Load(); err != nil || !reflect.DeepEqual(cp, want) {
+		t.Fatalf("got %+v and %v, want %+v", cp, err, want)
+	}
+	if _, err = os.Stat(store.Path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the temporary file to be renamed, got %v", err)
+	}
+}
+
+func TestCheckpointer(t *testing.T) {
+	var (
+		store = NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+		c     *Checkpointer
+		err   error
+	)
+	if c, err = NewCheckpointer(store); err != nil {
+		t.Fatal(err)
+	}
+	c.MaxSeen = 2
+	for _, record := range []InputRecord{
+		{ID: "a", Position: "1"},
+		{ID: "b", Position: "2"},
+		{ID: "b", Position: "2"},
+		{ID: "c"},
+	} {
+		if err = c.Commit(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.Position() != "2" {
+		t.Errorf("got position %q, want \"2\"", c.Position())
+	}
+	if c.Seen("a") || !c.Seen("b") || !c.Seen("c") {
+		t.Errorf("Expected only the last 2 IDs to be seen, got a=%v b=%v c=%v", c.Seen("a"), c.Seen("b"), c.Seen("c"))
+	}
+	if c, err = NewCheckpointer(store); err != nil {
+		t.Fatal(err)
+	}
+	if c.Position() != "2" || c.Seen("a") || !c.Seen("b") || !c.Seen("c") {
+		t.Errorf("Expected the checkpoint to reload, got position %q", c.Position())
+	}
+	if err = c.Reset("10"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = NewCheckpointer(store); err != nil {
+		t.Fatal(err)
+	}
+	if c.Position() != "10" || !c.Seen("c") {
+		t.Errorf("Expected Reset to move only the position, got position %q", c.Position())
+	}
+}
@@ -15,75 +15,154 @@
 package witgo
 
 import (
-	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 type HttpClient interface {
 	Do(req *http.Request) (resp *http.Response, err error)
 }
 
+const REDACTED = "REDACTED"
+
+// Writes requests and responses sent through another HttpClient to a log.
+// By default the Authorization header is masked and everything else is
+// logged in full.
 type LoggingHttpClient struct {
+	// Headers whose values are replaced with REDACTED.
+	RedactHeaders []string
+	// Query parameters whose values are replaced with REDACTED.
+	RedactParams []string
+	// Masks text which may have been written by or be about users: the q,
+	// context and dynamic_entities parameters and request and response
+	// bodies.
+	RedactUserText bool
+	// Truncates logged bodies to this many bytes.  Zero logs bodies in full.
+	MaxBodyLength int
+	// Logs one line per request instead of dumping requests and responses.
+	Compact bool
+
 	log    io.Writer
 	client HttpClient
 }
 
 func NewLoggingHttpClient(log io.Writer, client HttpClient) *LoggingHttpClient {
 	return &LoggingHttpClient{
-		log:    log,
-		client: client,
+		RedactHeaders: []string{"Authorization"},
+		log:           log,
+		client:        client,
 	}
 }
 
-func (c *LoggingHttpClient) logReq(req *http.Request) *http.Request {
+func (c *LoggingHttpClient) redactURL(u *url.URL) *url.URL {
 	var (
-		buf *bytes.Buffer
-		out *http.Request
-		err error
+		out   = *u
+		query = u.Query()
+		names = c.RedactParams
 	)
-	io.WriteString(c.log, "=====\nHTTP Req\n-----\n")
-	buf = bytes.NewBufferString("")
-	req.Write(buf)
-	if out, err = http.ReadRequest(bufio.NewReader(io.TeeReader(buf, c.log))); err != nil {
-		panic(err)
+	if c.RedactUserText {
+		names = append([]string{"q", "context", "dynamic_entities"}, names...)
 	}
-	// Make request usable as a client request.
-	out.RequestURI = ""
-	out.URL = req.URL
-	return out
+	for _, name := range names {
+		if _, found := query[name]; found {
+			query.Set(name, REDACTED)
+		}
+	}
+	out.RawQuery = query.Encode()
+	return &out
 }
 
-func (c *LoggingHttpClient) logResp(resp *http.Response) *http.Response {
-	var (
-		buf *bytes.Buffer
-		out *http.Response
-		err error
-	)
-	io.WriteString(c.log, "=====\nHTTP Resp\n-----\n")
-	buf = bytes.NewBufferString("")
-	resp.Write(buf)
-	if out, err = http.ReadResponse(bufio.NewReader(io.TeeReader(buf, c.log)), nil); err != nil {
-		panic(err)
+func (c *LoggingHttpClient) redactHeader(header http.Header) http.Header {
+	var out = header.Clone()
+	for _, name := range c.RedactHeaders {
+		if out.Get(name) != "" {
+			out.Set(name, REDACTED)
+		}
 	}
-	io.WriteString(c.log, "\n")
 	return out
 }
 
+func (c *LoggingHttpClient) redactBody(body []byte) []byte {
+	switch {
+	case len(body) == 0:
+		return body
+	case c.RedactUserText:
+		return []byte(fmt.Sprintf("[%v %d bytes]", REDACTED, len(body)))
+	case c.MaxBodyLength > 0 && len(body) > c.MaxBodyLength:
+		return []byte(fmt.Sprintf("%s... [%d bytes truncated]", body[:c.MaxBodyLength], len(body)-c.MaxBodyLength))
+	}
+	return body
+}
+
+func (c *LoggingHttpClient) logReq(req *http.Request, body []byte) {
+	var buf = bytes.NewBufferString("=====\nHTTP Req\n-----\n")
+	fmt.Fprintf(buf, "%v %v %v\r\n", req.Method, c.redactURL(req.URL).RequestURI(), req.Proto)
+	fmt.Fprintf(buf, "Host: %v\r\n", req.URL.Host)
+	c.redactHeader(req.Header).Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(c.redactBody(body))
+	c.log.Write(buf.Bytes())
+}
+
+func (c *LoggingHttpClient) logResp(resp *http.Response, body []byte) {
+	var buf = bytes.NewBufferString("=====\nHTTP Resp\n-----\n")
+	fmt.Fprintf(buf, "%v %v\r\n", resp.Proto, resp.Status)
+	c.redactHeader(resp.Header).Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(c.redactBody(body))
+	buf.WriteString("\n")
+	c.log.Write(buf.Bytes())
+}
+
+func (c *LoggingHttpClient) logCompact(req *http.Request, resp *http.Response, body []byte, elapsed time.Duration, err error) {
+	var result string
+	switch {
+	case err != nil:
+		result = fmt.Sprintf("error: %v", err)
+	default:
+		result = fmt.Sprintf("%v (%d bytes)", resp.Status, len(body))
+	}
+	fmt.Fprintf(c.log, "%v %v -> %v in %v\n", req.Method, c.redactURL(req.URL), result, elapsed.Round(time.Millisecond))
+}
+
 func (c *LoggingHttpClient) Do(req *http.Request) (resp *http.Response, err error) {
-	req = c.logReq(req)
-	if resp, err = c.client.Do(req); resp != nil {
-		resp = c.logResp(resp)
+	var (
+		reqBody  []byte
+		respBody []byte
+		start    = time.Now()
+	)
+	if reqBody, err = readRequestBody(req); err != nil {
+		return
+	}
+	if !c.Compact {
+		c.logReq(req, reqBody)
+	}
+	if resp, err = c.client.Do(req); err == nil {
+		respBody, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+		if !c.Compact {
+			c.logResp(resp, respBody)
+		}
+	}
+	if c.Compact {
+		c.logCompact(req, resp, respBody, time.Since(start), err)
 	}
 	return
 }
@@ -94,50 +173,187 @@ type Client struct {
 	Version           string
 	Base              string
 	UserAgent         string
+	// Receives a debug event for every API call.  Nil disables logging.
+	Logger *slog.Logger
+	// Receives measurements of every API call.  Nil disables metrics.
+	Metrics Metrics
+	// Starts a span for every API call.  Nil disables tracing.
+	Tracer Tracer
+	// Stores responses to Message.  Nil disables caching.  Requests with a
+	// MessageOptions.Context are never cached, as their entities resolve
+	// against the time and place they were made.
+	Cache MessageCache
+	// Limits the rate of API calls.  Nil disables rate limiting.
+	RateLimiter RateLimiter
+
+	insecure      bool
+	warnOnce      sync.Once
+	cacheMu       sync.Mutex
+	inflight      map[string]*inflightCall
+	cacheCounters cacheCounters
+}
+
+type clientConfig struct {
+	base        string
+	version     string
+	userAgent   string
+	proxy       func(*http.Request) (*url.URL, error)
+	rootCAs     *x509.CertPool
+	insecure    bool
+	timeout     time.Duration
+	httpClient  HttpClient
+	cache       MessageCache
+	rateLimiter RateLimiter
+}
+
+// Configures a Client created by NewClient.
+type ClientOption func(config *clientConfig)
+
+// Sends requests through the proxy at proxyURL.
+func WithProxy(proxyURL *url.URL) ClientOption {
+	return func(config *clientConfig) {
+		config.proxy = http.ProxyURL(proxyURL)
+	}
 }
 
-// Creates a new wit.ai client with the supplied token.
-// Supports the use of HTTP proxies through the $HTTP_PROXY env var.
+// Uses the $HTTP_PROXY, $HTTPS_PROXY and $NO_PROXY env vars to pick a proxy,
+// and disables TLS certificate verification if $TLS_INSECURE is set.
 // For example:
-//     export HTTP_PROXY=http://localhost:8080
 //
-// When using a proxy, disable TLS certificate verification with the following:
-//     export TLS_INSECURE=1
-func NewClient(accessToken string) *Client {
-	var (
-		req, _    = http.NewRequest("GET", "https://api.wit.ai", nil)
-		proxy, _  = http.ProxyFromEnvironment(req)
-		transport *http.Transport
-		tlsconfig *tls.Config
-	)
-	if proxy != nil {
-		tlsconfig = &tls.Config{
-			InsecureSkipVerify: getEnvEitherCase("TLS_INSECURE") != "",
+//	export HTTP_PROXY=http://localhost:8080
+//	export TLS_INSECURE=1
+func WithEnvironmentProxy() ClientOption {
+	return func(config *clientConfig) {
+		config.proxy = http.ProxyFromEnvironment
+		if getEnvEitherCase("TLS_INSECURE") != "" {
+			config.insecure = true
 		}
-		if tlsconfig.InsecureSkipVerify {
-			fmt.Printf("WARNING: SSL cert verification disabled\n")
+	}
+}
+
+// Verifies server certificates against pool instead of the system roots.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(config *clientConfig) {
+		config.rootCAs = pool
+	}
+}
+
+// Disables TLS certificate verification.  Do not use in production!
+func WithInsecureSkipVerify() ClientOption {
+	return func(config *clientConfig) {
+		config.insecure = true
+	}
+}
+
+// Limits the time taken by each request, including reading the response.
+// Zero means no limit.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(config *clientConfig) {
+		config.timeout = timeout
+	}
+}
+
+func WithBaseURL(base string) ClientOption {
+	return func(config *clientConfig) {
+		config.base = base
+	}
+}
+
+func WithAPIVersion(version string) ClientOption {
+	return func(config *clientConfig) {
+		config.version = version
+	}
+}
+
+func WithUserAgent(userAgent string) ClientOption {
+	return func(config *clientConfig) {
+		config.userAgent = userAgent
+	}
+}
+
+// Sends requests with httpClient.  Transport options are ignored.
+func WithHttpClient(httpClient HttpClient) ClientOption {
+	return func(config *clientConfig) {
+		config.httpClient = httpClient
+	}
+}
+
+// Limits the rate of API calls, see TokenBucket.
+func WithRateLimiter(limiter RateLimiter) ClientOption {
+	return func(config *clientConfig) {
+		config.rateLimiter = limiter
+	}
+}
+
+// Caches responses to Message, see MessageCache.
+func WithCache(cache MessageCache) ClientOption {
+	return func(config *clientConfig) {
+		config.cache = cache
+	}
+}
+
+// Returns a transport which keeps connections alive, attempts HTTP/2 and
+// times out stalled connections.
+func newTransport(config *clientConfig) *http.Transport {
+	return &http.Transport{
+		Proxy: config.proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig: &tls.Config{
+			RootCAs:            config.rootCAs,
+			InsecureSkipVerify: config.insecure,
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// Creates a new wit.ai client with the supplied token.  For example:
+//
+//	client = witgo.NewClient(token, witgo.WithTimeout(10*time.Second))
+//
+// Without options, requests go directly to https://api.wit.ai with a 30
+// second timeout.  Environment variables are only read if
+// WithEnvironmentProxy is passed.
+func NewClient(accessToken string, options ...ClientOption) *Client {
+	var (
+		config = &clientConfig{
+			base:      "https://api.wit.ai",
+			version:   "20170418",
+			userAgent: "github.com/yeyus/witgo",
+			timeout:   30 * time.Second,
 		}
-		transport = &http.Transport{
-			Proxy:              http.ProxyURL(proxy),
-			TLSClientConfig:    tlsconfig,
-			DisableCompression: true,
-			DisableKeepAlives:  true,
+		option ClientOption
+	)
+	for _, option = range options {
+		option(config)
+	}
+	if config.httpClient == nil {
+		config.httpClient = &http.Client{
+			Transport: newTransport(config),
+			Timeout:   config.timeout,
 		}
-	} else {
-		transport = &http.Transport{}
 	}
 	return &Client{
 		ServerAccessToken: accessToken,
-		Version:           "20170418",
-		Base:              "https://api.wit.ai",
-		UserAgent:         "github.com/yeyus/witgo",
-		HttpClient: &http.Client{
-			Transport: transport,
-		},
+		Version:           config.version,
+		Base:              config.base,
+		UserAgent:         config.userAgent,
+		HttpClient:        config.httpClient,
+		Cache:             config.cache,
+		RateLimiter:       config.rateLimiter,
+		insecure:          config.insecure,
 	}
 }
 
 func (c *Client) buildRequest(
+	ctx context.Context,
 	method string,
 	path string,
 	query url.Values,
@@ -153,7 +369,7 @@ func (c *Client) buildRequest(
 	}
 	query.Set("v", c.Version)
 	requestUrl = fmt.Sprintf("%v%v?%v", c.Base, path, query.Encode())
-	if request, err = http.NewRequest(method, requestUrl, body); err != nil {
+	if request, err = http.NewRequestWithContext(ctx, method, requestUrl, body); err != nil {
 		return
 	}
 	request.Header.Set("Accept", "application/json")
@@ -164,18 +380,18 @@ func (c *Client) buildRequest(
 	return
 }
 
-func (c *Client) buildGetRequest(path string, fields map[string]string) (request *http.Request, err error) {
+func (c *Client) buildGetRequest(ctx context.Context, path string, fields map[string]string) (request *http.Request, err error) {
 	var query = url.Values{}
 	for field, value := range fields {
 		if value != "" {
 			query.Set(field, value)
 		}
 	}
-	request, err = c.buildRequest("GET", path, query, "", nil)
+	request, err = c.buildRequest(ctx, "GET", path, query, "", nil)
 	return
 }
 
-func (c *Client) buildPostRequest(path string, fields map[string]string, payload interface{}) (request *http.Request, err error) {
+func (c *Client) buildPostRequest(ctx context.Context, path string, fields map[string]string, payload interface{}) (request *http.Request, err error) {
 	var (
 		query = url.Values{}
 		body  io.ReadWriter
@@ -190,11 +406,11 @@ func (c *Client) buildPostRequest(path string, fields map[string]string, payload
 			return
 		}
 	}
-	request, err = c.buildRequest("POST", path, query, "application/json", body)
+	request, err = c.buildRequest(ctx, "POST", path, query, "application/json", body)
 	return
 }
 
-func (c *Client) buildMultipartRequest(path string, fields map[string]string) (request *http.Request, err error) {
+func (c *Client) buildMultipartRequest(ctx context.Context, path string, fields map[string]string) (request *http.Request, err error) {
 	var (
 		typeHeader string
 		body       io.ReadWriter
@@ -207,38 +423,148 @@ func (c *Client) buildMultipartRequest(path string, fields map[string]string) (r
 		encoder.WriteField(field, value)
 	}
 	typeHeader = fmt.Sprintf("multipart/form-data;boundary=%v", encoder.Boundary())
-	request, err = c.buildRequest("POST", path, nil, typeHeader, body)
+	request, err = c.buildRequest(ctx, "POST", path, nil, typeHeader, body)
 	return
 }
 
+// Sends a request inside a span named after the endpoint.  The span's context
+// replaces the request's context so HTTP instrumentation can use it.  Waits
+// for the RateLimiter first; latency is measured from when the wait ends.
 func (c *Client) makeRequest(request *http.Request) (response *Response, err error) {
-	var r *http.Response
-	r, err = c.HttpClient.Do(request)
+	var (
+		r     *http.Response
+		start = time.Now()
+		ctx   context.Context
+		span  Span
+	)
+	ctx, span = startSpan(c.Tracer, request.Context(), "wit.ai "+request.URL.Path)
+	defer span.End()
+	span.SetAttribute("http.method", request.Method)
+	span.SetAttribute("http.endpoint", request.URL.Path)
+	request = request.WithContext(ctx)
+	if c.RateLimiter != nil {
+		if err = c.RateLimiter.Wait(ctx); err != nil {
+			span.RecordError(err)
+			return
+		}
+		start = time.Now()
+	}
+	if r, err = c.HttpClient.Do(request); err != nil {
+		span.RecordError(err)
+	} else {
+		span.SetAttribute("http.status_code", r.StatusCode)
+	}
 	response = (*Response)(r)
+	c.logRequest(request, r, time.Since(start), err)
+	if c.Metrics != nil {
+		var status int
+		if r != nil {
+			status = r.StatusCode
+		}
+		c.Metrics.ObserveRequest(request.URL.Path, status, time.Since(start))
+	}
 	return
 }
 
+// Reads msg_id from a response body, leaving the body readable.
+func peekMsgID(r *http.Response) string {
+	var (
+		b    []byte
+		err  error
+		data struct {
+			MsgID string `json:"msg_id"`
+		}
+	)
+	if r.Header.Get("Content-Encoding") != "" {
+		return ""
+	}
+	if b, err = ioutil.ReadAll(r.Body); err != nil {
+		return ""
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	json.Unmarshal(b, &data)
+	return data.MsgID
+}
+
+func (c *Client) logRequest(request *http.Request, r *http.Response, latency time.Duration, err error) {
+	var (
+		ctx   = context.Background()
+		attrs []slog.Attr
+	)
+	if c.Logger == nil {
+		return
+	}
+	if c.insecure {
+		c.warnOnce.Do(func() {
+			c.Logger.LogAttrs(ctx, slog.LevelWarn, "TLS certificate verification disabled")
+		})
+	}
+	attrs = []slog.Attr{
+		slog.String("method", request.Method),
+		slog.String("endpoint", request.URL.Path),
+		slog.Duration("latency", latency),
+	}
+	if err != nil {
+		c.Logger.LogAttrs(ctx, slog.LevelError, "wit.ai request failed", append(attrs, slog.Any("error", err))...)
+		return
+	}
+	attrs = append(attrs, slog.Int("status", r.StatusCode))
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		c.Logger.LogAttrs(ctx, slog.LevelWarn, "wit.ai request", attrs...)
+		return
+	}
+	if !c.Logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	if id := peekMsgID(r); id != "" {
+		attrs = append(attrs, slog.String("msg_id", id))
+	}
+	c.Logger.LogAttrs(ctx, slog.LevelDebug, "wit.ai request", attrs...)
+}
+
 func (c *Client) Message(msg string) (response *Response, err error) {
-	var request *http.Request
-	if request, err = c.buildGetRequest("/message", map[string]string{
-		"q": msg,
-	}); err != nil {
+	return c.MessageContext(context.Background(), msg)
+}
+
+func (c *Client) MessageContext(ctx context.Context, msg string) (response *Response, err error) {
+	return c.MessageWithOptions(ctx, msg, nil)
+}
+
+// Classifies msg with the /message endpoint.  A nil options sends only msg.
+// Requests with a Context bypass the Cache.
+func (c *Client) MessageWithOptions(ctx context.Context, msg string, options *MessageOptions) (response *Response, err error) {
+	var (
+		request *http.Request
+		fields  map[string]string
+	)
+	if fields, err = options.fields(msg); err != nil {
+		return
+	}
+	if request, err = c.buildGetRequest(ctx, "/message", fields); err != nil {
 		return
 	}
+	if c.Cache != nil && (options == nil || options.Context == nil) {
+		return c.makeCachedRequest(request)
+	}
 	if response, err = c.makeRequest(request); err != nil {
 		return
 	}
 	return
 }
 
-func (c *Client) Converse(sessionID SessionID, q string, context interface{}) (response *Response, err error) {
+func (c *Client) Converse(sessionID SessionID, q string, witContext interface{}) (response *Response, err error) {
+	return c.ConverseContext(context.Background(), sessionID, q, witContext)
+}
+
+func (c *Client) ConverseContext(ctx context.Context, sessionID SessionID, q string, witContext interface{}) (response *Response, err error) {
 	var (
 		request *http.Request
 	)
-	if request, err = c.buildPostRequest("/converse", map[string]string{
+	if request, err = c.buildPostRequest(ctx, "/converse", map[string]string{
 		"q":          q,
 		"session_id": string(sessionID),
-	}, context); err != nil {
+	}, witContext); err != nil {
 		return
 	}
 	if response, err = c.makeRequest(request); err != nil {
@@ -251,20 +577,6 @@ const (
 	STATUS_OK = 200
 )
 
-// Error returned if there was an issue parsing the response body.
-type ResponseError struct {
-	Body string
-	Code int
-}
-
-func NewResponseError(code int, body string) ResponseError {
-	return ResponseError{Code: code, Body: body}
-}
-
-func (e ResponseError) Error() string {
-	return fmt.Sprintf("Unable to handle response with code %d: `%v`", e.Code, e.Body)
-}
-
 type Response http.Response
 
 func (r Response) readBody() (b []byte, err error) {
@@ -299,23 +611,21 @@ func (r Response) ReadBody() string {
 }
 
 // Parses a JSON encoded HTTP response into the supplied interface.
+// Any 2xx status is a success; an empty body leaves out unchanged.
+// Other statuses return a ResponseError.
 func (r Response) Parse(out interface{}) (err error) {
 	var b []byte
-	switch r.StatusCode {
-	case STATUS_OK:
-		if b, err = r.readBody(); err != nil {
-			return
-		}
-		err = json.Unmarshal(b, out)
-		if err == io.EOF {
-			err = nil
-		}
-	default:
-		if b, err = r.readBody(); err != nil {
-			return
-		}
-		err = NewResponseError(r.StatusCode, string(b))
+	if b, err = r.readBody(); err != nil {
+		return
+	}
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		err = newResponseError(r.StatusCode, r.Header, b)
+		return
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return
 	}
+	err = json.Unmarshal(b, out)
 	return
 }
 
@@ -0,0 +1,163 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggingHttpClientRedacts(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"_text": "my secret plans"}`)
+	}))
+	defer server.Close()
+	var query = url.Values{
+		"q":                {"my secret plans"},
+		"session_id":       {"s-123"},
+		"context":          {`{"timezone": "Europe/Paris"}`},
+		"dynamic_entities": {`{"contact": [{"keyword": "Alice"}]}`},
+	}.Encode()
+	var tests = []struct {
+		name   string
+		setup  func(c *LoggingHttpClient)
+		want   []string
+		absent []string
+	}{
+		{
+			name:   "default",
+			setup:  func(c *LoggingHttpClient) {},
+			want:   []string{"Authorization: " + REDACTED, "q=my+secret+plans", `"_text": "my secret plans"`},
+			absent: []string{"Bearer token"},
+		},
+		{
+			name:  "user text",
+			setup: func(c *LoggingHttpClient) { c.RedactUserText = true },
+			want: []string{
+				"q=" + REDACTED,
+				"context=" + REDACTED,
+				"dynamic_entities=" + REDACTED,
+				"[" + REDACTED + " 28 bytes]",
+			},
+			absent: []string{"Bearer token", "secret", "Europe", "Alice"},
+		},
+		{
+			name: "params and headers",
+			setup: func(c *LoggingHttpClient) {
+				c.RedactParams = []string{"session_id"}
+				c.RedactHeaders = []string{"X-Trace"}
+			},
+			want:   []string{"session_id=" + REDACTED, "X-Trace: " + REDACTED, "Bearer token"},
+			absent: []string{"s-123", "trace-456"},
+		},
+		{
+			name:   "truncated",
+			setup:  func(c *LoggingHttpClient) { c.MaxBodyLength = 5 },
+			want:   []string{`{"_te... [23 bytes truncated]`},
+			absent: []string{`plans"}`},
+		},
+		{
+			name:   "compact",
+			setup:  func(c *LoggingHttpClient) { c.Compact = true; c.RedactUserText = true },
+			want:   []string{"GET " + server.URL, "q=" + REDACTED, "200 OK (28 bytes)"},
+			absent: []string{"secret", "Bearer"},
+		},
+	}
+	for _, test := range tests {
+		var (
+			log     bytes.Buffer
+			logging = NewLoggingHttpClient(&log, http.DefaultClient)
+			request *http.Request
+			err     error
+		)
+		test.setup(logging)
+		if request, err = http.NewRequest("GET", server.URL+"/message?"+query, nil); err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer token")
+		request.Header.Set("X-Trace", "trace-456")
+		if _, err = logging.Do(request); err != nil {
+			t.Errorf("%v: got error %v", test.name, err)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(log.String(), want) {
+				t.Errorf("%v: got log %q, want it to contain %q", test.name, log.String(), want)
+			}
+		}
+		for _, absent := range test.absent {
+			if strings.Contains(log.String(), absent) {
+				t.Errorf("%v: got log %q, want it not to contain %q", test.name, log.String(), absent)
+			}
+		}
+	}
+}
+
+// Returns the transport NewClient built for options.
+func clientTransport(t *testing.T, options ...ClientOption) (httpClient *http.Client, transport *http.Transport) {
+	var ok bool
+	if httpClient, ok = NewClient("token", options...).HttpClient.(*http.Client); !ok {
+		t.Fatalf("Expected an *http.Client")
+	}
+	if transport, ok = httpClient.Transport.(*http.Transport); !ok {
+		t.Fatalf("Expected an *http.Transport, got %T", httpClient.Transport)
+	}
+	return
+}
+
+func TestNewClientDefaultTransport(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://localhost:8080")
+	t.Setenv("HTTPS_PROXY", "http://localhost:8080")
+	t.Setenv("TLS_INSECURE", "1")
+	var httpClient, transport = clientTransport(t)
+	if httpClient.Timeout != 30*time.Second {
+		t.Errorf("got timeout %v, want 30s", httpClient.Timeout)
+	}
+	if transport.Proxy != nil {
+		t.Errorf("Expected no proxy without WithEnvironmentProxy")
+	}
+	if transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("Expected certificates to be verified without WithEnvironmentProxy")
+	}
+	if !transport.ForceAttemptHTTP2 || transport.MaxIdleConns == 0 || transport.ResponseHeaderTimeout == 0 {
+		t.Errorf("Expected a tuned transport, got %+v", transport)
+	}
+}
+
+func TestWithEnvironmentProxy(t *testing.T) {
+	var tests = []struct {
+		insecure string
+		want     bool
+	}{
+		{"", false},
+		{"1", true},
+	}
+	for _, test := range tests {
+		t.Setenv("TLS_INSECURE", test.insecure)
+		var _, transport = clientTransport(t, WithEnvironmentProxy(), WithTimeout(time.Second))
+		if transport.Proxy == nil {
+			t.Errorf("%q: Expected the proxy to be read from the environment", test.insecure)
+		}
+		if transport.TLSClientConfig.InsecureSkipVerify != test.want {
+			t.Errorf("%q: got InsecureSkipVerify %v, want %v", test.insecure, transport.TLSClientConfig.InsecureSkipVerify, test.want)
+		}
+	}
+}
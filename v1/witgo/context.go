@@ -35,3 +35,10 @@ func (c Context) Merge(other Context) Context {
 	}
 	return c
 }
+
+func (c Context) Delete(keys ...string) Context {
+	for _, key := range keys {
+		delete(c, key)
+	}
+	return c
+}
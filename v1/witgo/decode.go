@@ -0,0 +1,227 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	dateTimeType = reflect.TypeOf(DateTime{})
+	moneyType    = reflect.TypeOf(Money{})
+	locationType = reflect.TypeOf(Location{})
+	entityType   = reflect.TypeOf(Entity{})
+)
+
+// The options of a field tagged with `witgo:"key,required,minconf=0.7"`.
+type decodeTag struct {
+	Key      string
+	Required bool
+	MinConf  float64
+}
+
+func parseDecodeTag(tag string) (out decodeTag, err error) {
+	var parts = strings.Split(tag, ",")
+	out.Key = parts[0]
+	for _, part := range parts[1:] {
+		switch {
+		case part == "required":
+			out.Required = true
+		case strings.HasPrefix(part, "minconf="):
+			if out.MinConf, err = strconv.ParseFloat(strings.TrimPrefix(part, "minconf="), 64); err != nil {
+				err = fmt.Errorf("Invalid minconf in tag %q: %v", tag, err)
+				return
+			}
+		case part == "":
+		default:
+			err = fmt.Errorf("Unknown option %q in tag %q", part, tag)
+			return
+		}
+	}
+	return
+}
+
+// Sets the fields of the struct pointed to by dst from the entities named by
+// their `witgo` tags.  A tag holds the entity key followed by options:
+//
+//	Location string    `witgo:"location,required,minconf=0.7"`
+//	When     time.Time `witgo:"datetime"`
+//	Tags     []string  `witgo:"tag"`
+//
+// An empty key uses the field name.  Fields without a tag, or tagged "-",
+// are left alone.  Entities with a confidence below minconf are ignored and
+// the most confident of the rest is used, or all of them for slice fields.
+// Fields may be strings, bools, numbers, time.Time, time.Duration, DateTime,
+// Money, Location or Entity, pointers to these or slices of them.  Fields
+// with no matching entities are left unchanged.
+//
+// Returns the keys of required fields with no matching entities.  An error
+// is returned only if dst is not a pointer to a struct or an entity could
+// not be converted.
+func (m EntityMap) Decode(dst interface{}) (missing []string, err error) {
+	var (
+		value    = reflect.ValueOf(dst)
+		field    reflect.StructField
+		tag      decodeTag
+		entities []*Entity
+		raw      string
+		i        int
+	)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		err = fmt.Errorf("Decode requires a pointer to a struct, got %T", dst)
+		return
+	}
+	value = value.Elem()
+	for i = 0; i < value.NumField(); i++ {
+		field = value.Type().Field(i)
+		if raw = field.Tag.Get("witgo"); raw == "" || raw == "-" || !field.IsExported() {
+			continue
+		}
+		if tag, err = parseDecodeTag(raw); err != nil {
+			return
+		}
+		if tag.Key == "" {
+			tag.Key = field.Name
+		}
+		if entities = m.AboveThreshold(tag.Key, tag.MinConf); len(entities) == 0 {
+			if tag.Required {
+				missing = append(missing, tag.Key)
+			}
+			continue
+		}
+		if err = decodeField(value.Field(i), entities); err != nil {
+			err = fmt.Errorf("Could not decode %v into %v: %v", tag.Key, field.Name, err)
+			return
+		}
+	}
+	return
+}
+
+// Sets a field from entities ordered by decreasing confidence.
+func decodeField(field reflect.Value, entities []*Entity) (err error) {
+	var (
+		slice reflect.Value
+		ptr   reflect.Value
+	)
+	switch {
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8:
+		slice = reflect.MakeSlice(field.Type(), len(entities), len(entities))
+		for i, entity := range entities {
+			if err = decodeField(slice.Index(i), []*Entity{entity}); err != nil {
+				return
+			}
+		}
+		field.Set(slice)
+	case field.Kind() == reflect.Ptr:
+		ptr = reflect.New(field.Type().Elem())
+		if err = decodeField(ptr.Elem(), entities); err != nil {
+			return
+		}
+		field.Set(ptr)
+	default:
+		err = decodeValue(field, entities[0])
+	}
+	return
+}
+
+func decodeValue(field reflect.Value, entity *Entity) (err error) {
+	var (
+		number   float64
+		boolean  bool
+		duration time.Duration
+		datetime DateTime
+		money    Money
+		location Location
+	)
+	switch field.Type() {
+	case timeType:
+		if datetime, err = entity.DateTime(); err != nil {
+			return
+		}
+		if datetime.Interval {
+			if datetime.From == nil {
+				return fmt.Errorf("Interval has no start")
+			}
+			datetime.DateTimeValue = *datetime.From
+		}
+		field.Set(reflect.ValueOf(datetime.Time))
+		return
+	case durationType:
+		if duration, err = entity.Duration(); err == nil {
+			field.SetInt(int64(duration))
+		}
+		return
+	case dateTimeType:
+		if datetime, err = entity.DateTime(); err == nil {
+			field.Set(reflect.ValueOf(datetime))
+		}
+		return
+	case moneyType:
+		if money, err = entity.Money(); err == nil {
+			field.Set(reflect.ValueOf(money))
+		}
+		return
+	case locationType:
+		if location, err = entity.Location(); err == nil {
+			field.Set(reflect.ValueOf(location))
+		}
+		return
+	case entityType:
+		field.Set(reflect.ValueOf(*entity))
+		return
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(entity.Value)
+	case reflect.Bool:
+		if boolean, err = strconv.ParseBool(entity.Value); err == nil {
+			field.SetBool(boolean)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if number, err = entity.Number(); err != nil {
+			return
+		}
+		if number != float64(int64(number)) || field.OverflowInt(int64(number)) {
+			return fmt.Errorf("%v does not fit in %v", number, field.Type())
+		}
+		field.SetInt(int64(number))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if number, err = entity.Number(); err != nil {
+			return
+		}
+		if number < 0 || number != float64(uint64(number)) || field.OverflowUint(uint64(number)) {
+			return fmt.Errorf("%v does not fit in %v", number, field.Type())
+		}
+		field.SetUint(uint64(number))
+	case reflect.Float32, reflect.Float64:
+		if number, err = entity.Number(); err == nil {
+			field.SetFloat(number)
+		}
+	case reflect.Interface:
+		if field.NumMethod() != 0 {
+			return fmt.Errorf("Unsupported field type %v", field.Type())
+		}
+		field.Set(reflect.ValueOf(entity.Value))
+	default:
+		err = fmt.Errorf("Unsupported field type %v", field.Type())
+	}
+	return
+}
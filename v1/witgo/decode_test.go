@@ -0,0 +1,152 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEntityMapDecode(t *testing.T) {
+	type (
+		basic struct {
+			Location string  `witgo:"location,required"`
+			Count    int     `witgo:"number"`
+			Ratio    float64 `witgo:"number"`
+			Yes      bool    `witgo:"yes_no"`
+			Ignored  string
+			Skipped  string `witgo:"-"`
+		}
+		confident struct {
+			Location string   `witgo:"location,minconf=0.7"`
+			All      []string `witgo:"location"`
+		}
+		required struct {
+			Location string `witgo:"location,required"`
+			Contact  string `witgo:"contact,required,minconf=0.5"`
+		}
+		builtins struct {
+			When     time.Time     `witgo:"datetime"`
+			Length   time.Duration `witgo:"duration"`
+			Price    *Money        `witgo:"amount_of_money"`
+			Location string
+		}
+		unnamed struct {
+			Location string `witgo:""`
+		}
+		overflow struct {
+			Count int8 `witgo:"number"`
+		}
+		negative struct {
+			Count uint `witgo:"number"`
+		}
+		badTag struct {
+			Location string `witgo:"location,sometimes"`
+		}
+	)
+	var entities EntityMap
+	if err := json.Unmarshal([]byte(`{
+		"location": [
+			{"value": "Paris", "confidence": 0.6},
+			{"value": "Lyon", "confidence": 0.9}
+		],
+		"number": [{"type": "value", "value": 3, "confidence": 1}],
+		"big": [{"type": "value", "value": 300, "confidence": 1}],
+		"yes_no": [{"value": "true", "confidence": 1}],
+		"contact": [{"value": "Jane", "confidence": 0.2}],
+		"datetime": [{"type": "value", "value": "2016-05-01T09:00:00.000Z", "grain": "hour", "confidence": 1}],
+		"duration": [{"value": 2, "unit": "minute", "normalized": {"value": 120, "unit": "second"}, "confidence": 1}],
+		"amount_of_money": [{"type": "value", "value": 5, "unit": "EUR", "confidence": 1}]
+	}`), &entities); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name    string
+		dst     interface{}
+		want    interface{}
+		missing []string
+		err     bool
+	}{
+		{
+			name: "basic",
+			dst:  &basic{Ignored: "kept", Skipped: "kept"},
+			want: &basic{Location: "Lyon", Count: 3, Ratio: 3, Yes: true, Ignored: "kept", Skipped: "kept"},
+		},
+		{
+			name: "minconf",
+			dst:  &confident{},
+			want: &confident{Location: "Lyon", All: []string{"Lyon", "Paris"}},
+		},
+		{
+			name:    "required",
+			dst:     &required{},
+			want:    &required{Location: "Lyon"},
+			missing: []string{"contact"},
+		},
+		{
+			name: "builtins",
+			dst:  &builtins{Location: "untagged"},
+			want: &builtins{
+				When:     time.Date(2016, 5, 1, 9, 0, 0, 0, time.UTC),
+				Length:   2 * time.Minute,
+				Price:    &Money{Amount: 5, Unit: "EUR"},
+				Location: "untagged",
+			},
+		},
+		{
+			name: "field name as key",
+			dst: &struct {
+				Location string `witgo:",required"`
+			}{},
+			want: &struct {
+				Location string `witgo:",required"`
+			}{},
+			missing: []string{"Location"},
+		},
+		{name: "empty tag is ignored", dst: &unnamed{}, want: &unnamed{}},
+		{name: "overflow", dst: &struct {
+			Count int8 `witgo:"big"`
+		}{}, err: true},
+		{name: "fits", dst: &overflow{}, want: &overflow{Count: 3}},
+		{name: "unsigned", dst: &negative{}, want: &negative{Count: 3}},
+		{name: "bad tag", dst: &badTag{}, err: true},
+		{name: "not a pointer", dst: basic{}, err: true},
+		{name: "nil pointer", dst: (*basic)(nil), err: true},
+		{name: "unsupported type", dst: &struct {
+			Location chan int `witgo:"location"`
+		}{}, err: true},
+	}
+	for _, test := range tests {
+		missing, err := entities.Decode(test.dst)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: got no error, want one", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: got error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(missing, test.missing) {
+			t.Errorf("%v: got missing %v, want %v", test.name, missing, test.missing)
+		}
+		if !reflect.DeepEqual(test.dst, test.want) {
+			t.Errorf("%v: got %+v, want %+v", test.name, test.dst, test.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"strings"
+)
+
+// Context keys holding the state of a DialogueEngine.
+const (
+	DIALOGUE_INTENT  = "_intent"
+	DIALOGUE_CONFIRM = "_confirm"
+)
+
+// A value required by an intent.
+type Slot struct {
+	// The Context key the value is stored under.
+	Name string
+	// The entity which fills the slot.  Defaults to Name.
+	Entity string
+	// Said when the slot is missing.
+	Prompt string
+	// Entities with a lower confidence are ignored.
+	MinConfidence float64
+	// Optional slots are filled when their entity is present but never
+	// asked for.
+	Optional bool
+	// Returns the value to store for an entity.  An error rejects the entity
+	// and its message is said to the user before asking again.  Nil stores
+	// Entity.Value.
+	Validate func(session *Session, entity *Entity) (value interface{}, err error)
+}
+
+func (s *Slot) entity() string {
+	if s.Entity == "" {
+		return s.Name
+	}
+	return s.Entity
+}
+
+// An intent handled by a DialogueEngine.
+type DialogueIntent struct {
+	Name  string
+	Slots []*Slot
+	// Said once every required slot is filled.  The action runs after the
+	// user affirms.  Empty runs the action without confirmation.
+	Confirm string
+	// Passed to Handler.Action once the slots are filled and confirmed.
+	// Defaults to Name.
+	Action string
+	// Said after the action has run.
+	Done string
+}
+
+func (i *DialogueIntent) action() string {
+	if i.Action == "" {
+		return i.Name
+	}
+	return i.Action
+}
+
+// An Engine which fills the slots of intents recognized by the /message
+// endpoint, for apps without /converse stories.
+//
+// The engine keeps the active intent and its slots in Session.Context.
+// Each turn fills any slot whose entity is present in the message, then asks
+// for the first missing required slot.  Once every required slot is filled
+// and confirmed, the intent's action is passed to Handler.Action, which
+// finds the values in Session.Context, and the slots are cleared.
+// Handler.Merge is not used.
+//
+// A new intent replaces the active one.  The deny intent, or an answer such
+// as "no" or "cancel", abandons it.
+type DialogueEngine struct {
+	Intents map[string]*DialogueIntent
+	// Intents with a lower confidence are ignored.
+	MinConfidence float64
+	// Intents which answer a confirmation.  Plain answers such as "yes" and
+	// "no" are recognized as well.
+	AffirmIntent string
+	DenyIntent   string
+	// Said when no intent is active and the message has none.
+	Fallback string
+	// Said when the user abandons an intent.
+	Cancelled string
+}
+
+func NewDialogueEngine(intents ...*DialogueIntent) *DialogueEngine {
+	var e = &DialogueEngine{
+		Intents:      map[string]*DialogueIntent{},
+		AffirmIntent: "affirm",
+		DenyIntent:   "deny",
+		Fallback:     "Sorry, I didn't understand that.",
+		Cancelled:    "Okay, cancelled.",
+	}
+	for _, intent := range intents {
+		e.Add(intent)
+	}
+	return e
+}
+
+func (e *DialogueEngine) Add(intent *DialogueIntent) *DialogueEngine {
+	e.Intents[intent.Name] = intent
+	return e
+}
+
+var (
+	affirmAnswers = map[string]bool{"yes": true, "y": true, "yeah": true, "yep": true, "sure": true, "ok": true, "okay": true}
+	denyAnswers   = map[string]bool{"no": true, "n": true, "nope": true, "cancel": true, "stop": true}
+)
+
+func normalizeAnswer(q string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(q)), ".!")
+}
+
+func (e *DialogueEngine) isAffirm(intent string, q string) bool {
+	return (intent != "" && intent == e.AffirmIntent) || affirmAnswers[normalizeAnswer(q)]
+}
+
+func (e *DialogueEngine) isDeny(intent string, q string) bool {
+	return (intent != "" && intent == e.DenyIntent) || denyAnswers[normalizeAnswer(q)]
+}
+
+// Returns the intent stored in the session, or nil.
+func (e *DialogueEngine) active(session *Session) *DialogueIntent {
+	var name, _ = session.Context.Get(DIALOGUE_INTENT).(string)
+	return e.Intents[name]
+}
+
+// Removes the state of intent from the session.
+func (e *DialogueEngine) clear(session *Session, intent *DialogueIntent) {
+	session.Context.Delete(DIALOGUE_INTENT, DIALOGUE_CONFIRM)
+	if intent != nil {
+		for _, slot := range intent.Slots {
+			session.Context.Delete(slot.Name)
+		}
+	}
+}
+
+func (e *DialogueEngine) say(steps Steps, session *Session, msg string) (*Session, error) {
+	if msg == "" {
+		return session, nil
+	}
+	return steps.Say(session, msg)
+}
+
+func (e *DialogueEngine) complete(steps Steps, session *Session, intent *DialogueIntent, entities EntityMap) (out *Session, err error) {
+	if out, err = steps.Action(session, entities, intent.action()); err != nil {
+		return
+	}
+	if out, err = e.say(steps, out, intent.Done); err != nil {
+		return
+	}
+	e.clear(out, intent)
+	return
+}
+
+// Fills the slots of intent from entities, saying the message of any
+// validation error.
+func (e *DialogueEngine) fill(steps Steps, session *Session, intent *DialogueIntent, entities EntityMap) (out *Session, err error) {
+	var (
+		matches []*Entity
+		value   interface{}
+		invalid error
+	)
+	out = session
+	for _, slot := range intent.Slots {
+		if matches = entities.AboveThreshold(slot.entity(), slot.MinConfidence); len(matches) == 0 {
+			continue
+		}
+		value = matches[0].Value
+		if slot.Validate != nil {
+			if value, invalid = slot.Validate(out, matches[0]); invalid != nil {
+				if out, err = e.say(steps, out, invalid.Error()); err != nil {
+					return
+				}
+				continue
+			}
+		}
+		out.Context.Set(slot.Name, value)
+	}
+	return
+}
+
+func (e *DialogueEngine) Turn(steps Steps, session *Session, q string) (out *Session, err error) {
+	var (
+		response   *MessageResponse
+		name       string
+		confidence float64
+		intent     *DialogueIntent
+		active     *DialogueIntent
+		found      bool
+	)
+	if response, err = steps.Message(q); err != nil {
+		return
+	}
+	name, confidence = response.Intent()
+	if confidence < e.MinConfidence {
+		name = ""
+	}
+	if active = e.active(session); active != nil {
+		if e.isDeny(name, q) {
+			e.clear(session, active)
+			return e.say(steps, session, e.Cancelled)
+		}
+		if session.Context.Get(DIALOGUE_CONFIRM) == true {
+			if e.isAffirm(name, q) {
+				return e.complete(steps, session, active, response.Entities)
+			}
+			return e.say(steps, session, active.Confirm)
+		}
+	}
+	if intent, found = e.Intents[name]; found && intent != active {
+		e.clear(session, active)
+		active = intent
+		session.Context.Set(DIALOGUE_INTENT, active.Name)
+	}
+	if active == nil {
+		return e.say(steps, session, e.Fallback)
+	}
+	if session, err = e.fill(steps, session, active, response.Entities); err != nil {
+		return
+	}
+	for _, slot := range active.Slots {
+		if _, found = session.Context[slot.Name]; !found && !slot.Optional {
+			return e.say(steps, session, slot.Prompt)
+		}
+	}
+	if active.Confirm != "" {
+		session.Context.Set(DIALOGUE_CONFIRM, true)
+		return e.say(steps, session, active.Confirm)
+	}
+	return e.complete(steps, session, active, response.Entities)
+}
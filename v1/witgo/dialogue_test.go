@@ -0,0 +1,189 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo_test
+
+import (
+	"errors"
+	"github.com/kurrik/witgo/v1/witgo"
+	"github.com/kurrik/witgo/v1/witgo/witgotest"
+	"testing"
+)
+
+func newDialogueServer() *witgotest.Server {
+	var (
+		server = witgotest.NewServer()
+		intent = func(name string) []*witgo.MessageIntent {
+			return []*witgo.MessageIntent{{Name: name, Confidence: 1}}
+		}
+		entity = func(value string) []*witgo.Entity {
+			return []*witgo.Entity{{Value: value, Confidence: 1}}
+		}
+	)
+	server.AddMessage("Book a trip", &witgo.MessageResponse{Intents: intent("book")})
+	server.AddMessage("To Paris", &witgo.MessageResponse{Entities: witgo.EntityMap{"city": entity("Paris")}})
+	server.AddMessage("Yesterday", &witgo.MessageResponse{Entities: witgo.EntityMap{"datetime": entity("yesterday")}})
+	server.AddMessage("Tomorrow", &witgo.MessageResponse{Entities: witgo.EntityMap{"datetime": entity("tomorrow")}})
+	server.AddMessage("Book Paris tomorrow", &witgo.MessageResponse{
+		Intents:  intent("book"),
+		Entities: witgo.EntityMap{"city": entity("Paris"), "datetime": entity("tomorrow")},
+	})
+	server.AddMessage("Weather in Rome", &witgo.MessageResponse{
+		Intents:  intent("weather"),
+		Entities: witgo.EntityMap{"city": entity("Rome")},
+	})
+	return server
+}
+
+func newDialogueEngine() *witgo.DialogueEngine {
+	return witgo.NewDialogueEngine(
+		&witgo.DialogueIntent{
+			Name: "book",
+			Slots: []*witgo.Slot{
+				{Name: "city", Prompt: "Which city?"},
+				{Name: "date", Entity: "datetime", Prompt: "When?", Validate: func(session *witgo.Session, entity *witgo.Entity) (interface{}, error) {
+					if entity.Value == "yesterday" {
+						return nil, errors.New("Pick a future date.")
+					}
+					return "2016-05-05", nil
+				}},
+				{Name: "guests", Optional: true},
+			},
+			Confirm: "Shall I book it?",
+			Action:  "bookTrip",
+			Done:    "Booked!",
+		},
+		&witgo.DialogueIntent{
+			Name:  "weather",
+			Slots: []*witgo.Slot{{Name: "city", Prompt: "Where?"}},
+		},
+	)
+}
+
+func TestDialogueEngine(t *testing.T) {
+	var tests = []struct {
+		name    string
+		script  func(c *witgotest.Conversation)
+		want    string
+		cleared bool
+	}{
+		{
+			name: "fills slots and prompts for missing ones",
+			script: func(c *witgotest.Conversation) {
+				c.User("Book a trip").
+					ExpectContext(witgo.DIALOGUE_INTENT, "book").
+					User("To Paris").
+					ExpectContext("city", "Paris").
+					User("Yesterday").
+					User("Tomorrow").
+					ExpectContext("date", "2016-05-05").
+					ExpectContext(witgo.DIALOGUE_CONFIRM, true).
+					User("yes")
+			},
+			want: `user "Book a trip"
+  say "Which city?"
+user "To Paris"
+  say "When?"
+user "Yesterday"
+  say "Pick a future date."
+  say "When?"
+user "Tomorrow"
+  say "Shall I book it?"
+user "yes"
+  action bookTrip
+  say "Booked!"
+`,
+			cleared: true,
+		},
+		{
+			name: "asks again until the confirmation is answered",
+			script: func(c *witgotest.Conversation) {
+				c.User("Book Paris tomorrow").User("Maybe").User("sure")
+			},
+			want: `user "Book Paris tomorrow"
+  say "Shall I book it?"
+user "Maybe"
+  say "Shall I book it?"
+user "sure"
+  action bookTrip
+  say "Booked!"
+`,
+			cleared: true,
+		},
+		{
+			name: "deny cancels",
+			script: func(c *witgotest.Conversation) {
+				c.User("Book Paris tomorrow").User("No.")
+			},
+			want: `user "Book Paris tomorrow"
+  say "Shall I book it?"
+user "No."
+  say "Okay, cancelled."
+`,
+			cleared: true,
+		},
+		{
+			name: "a new intent replaces the active one",
+			script: func(c *witgotest.Conversation) {
+				c.User("Book a trip").
+					User("To Paris").
+					User("Weather in Rome")
+			},
+			want: `user "Book a trip"
+  say "Which city?"
+user "To Paris"
+  say "When?"
+user "Weather in Rome"
+  action weather city=Rome
+`,
+			cleared: true,
+		},
+		{
+			name: "fallback without an intent",
+			script: func(c *witgotest.Conversation) {
+				c.User("To Paris")
+			},
+			want: `user "To Paris"
+  say "Sorry, I didn't understand that."
+`,
+		},
+	}
+	for _, test := range tests {
+		var (
+			server     = newDialogueServer()
+			conv       = witgotest.NewConversation(server.Client, witgotest.NewMockHandler())
+			transcript witgotest.Transcript
+			err        error
+		)
+		conv.Engine = newDialogueEngine()
+		test.script(conv)
+		transcript, err = conv.Run()
+		server.Close()
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if got := transcript.String(); got != test.want {
+			t.Errorf("%v: got transcript:\n%v\nwant:\n%v", test.name, got, test.want)
+		}
+		if !test.cleared {
+			continue
+		}
+		for _, key := range []string{witgo.DIALOGUE_INTENT, witgo.DIALOGUE_CONFIRM, "city", "date"} {
+			if value, found := transcript[len(transcript)-1].Context[key]; found {
+				t.Errorf("%v: Expected %v to be cleared, got %v", test.name, key, value)
+			}
+		}
+	}
+}
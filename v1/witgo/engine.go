@@ -0,0 +1,152 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// Drives the dialogue of a single turn.  Engines talk to wit.ai and to the
+// Handler through Steps, which traces, measures and routes each call.
+type Engine interface {
+	Turn(steps Steps, session *Session, q string) (out *Session, err error)
+}
+
+// The operations available to an Engine during a turn.
+type Steps interface {
+	// Returns the context of the turn, which carries its tracing span.
+	Context() context.Context
+	// Classifies q with the /message endpoint, using the MessageOptions of
+	// Witgo for the session of the turn.
+	Message(q string) (response *MessageResponse, err error)
+	// Runs the next step of a story with the /converse endpoint.
+	Converse(session *Session, q string) (response *ConverseResponse, err error)
+	// Runs Handler.Action.
+	Action(session *Session, entities EntityMap, action string) (out *Session, err error)
+	// Runs Handler.Merge.
+	Merge(session *Session, entities EntityMap) (out *Session, err error)
+	// Renders msg with the Renderer of Witgo and delivers it through the
+	// Handler if it implements Sayer, or else through the Responder.
+	Say(session *Session, msg string) (out *Session, err error)
+}
+
+// Runs the stories of a wit.ai app through the /converse endpoint.
+// This is the default Engine of Witgo.
+type ConverseEngine struct{}
+
+func (e ConverseEngine) Turn(steps Steps, session *Session, q string) (out *Session, err error) {
+	var (
+		converse *ConverseResponse
+		done     bool = false
+	)
+	for !done {
+		if converse, err = steps.Converse(session, q); err != nil {
+			return
+		}
+		switch strings.ToLower(converse.Type) {
+		case "action":
+			if session, err = steps.Action(session, converse.Entities, converse.Action); err != nil {
+				return
+			}
+		case "msg":
+			if session, err = steps.Say(session, converse.Msg); err != nil {
+				return
+			}
+		case "merge":
+			if session, err = steps.Merge(session, converse.Entities); err != nil {
+				return
+			}
+		case "stop":
+			done = true
+		default:
+			done = true
+		}
+		q = ""
+	}
+	out = session
+	return
+}
+
+// The Steps of a turn being processed by Witgo.
+type turnSteps struct {
+	w        *Witgo
+	ctx      context.Context
+	session  *Session
+	count    int
+	messages []string
+}
+
+func (s *turnSteps) Context() context.Context {
+	return s.ctx
+}
+
+func (s *turnSteps) Message(q string) (out *MessageResponse, err error) {
+	var (
+		response *Response
+		intent   string
+		options  *MessageOptions
+	)
+	if s.w.MessageOptions != nil {
+		options = s.w.MessageOptions(s.session)
+	}
+	if response, err = s.w.client.MessageWithOptions(s.ctx, q, options); err != nil {
+		return
+	}
+	if err = response.Parse(&out); err != nil {
+		return
+	}
+	s.count++
+	intent, _ = out.Intent()
+	s.w.log(slog.LevelDebug, "message step",
+		slog.String("msg_id", out.MsgID),
+		slog.String("intent", intent),
+	)
+	return
+}
+
+func (s *turnSteps) Converse(session *Session, q string) (out *ConverseResponse, err error) {
+	var response *Response
+	if response, err = s.w.client.ConverseContext(s.ctx, session.ID(), q, session.Context); err != nil {
+		return
+	}
+	if err = response.Parse(&out); err != nil {
+		return
+	}
+	s.count++
+	s.w.log(slog.LevelDebug, "converse step",
+		slog.String("session", string(session.ID())),
+		slog.String("type", out.Type),
+		slog.String("action", out.Action),
+	)
+	return
+}
+
+func (s *turnSteps) Action(session *Session, entities EntityMap, action string) (*Session, error) {
+	return s.w.action(s.ctx, session, entities, action)
+}
+
+func (s *turnSteps) Merge(session *Session, entities EntityMap) (*Session, error) {
+	return s.w.merge(s.ctx, session, entities)
+}
+
+func (s *turnSteps) Say(session *Session, msg string) (out *Session, err error) {
+	var said string
+	if out, said, err = s.w.say(s.ctx, session, msg); err == nil {
+		s.messages = append(s.messages, said)
+	}
+	return
+}
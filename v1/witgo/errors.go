@@ -0,0 +1,156 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Kinds of ResponseError, for use with errors.Is.  For example:
+//
+//	if errors.Is(err, witgo.ErrRateLimited) {
+//		var respErr witgo.ResponseError
+//		errors.As(err, &respErr)
+//		time.Sleep(respErr.RetryAfter())
+//	}
+var (
+	ErrBadRequest   = errors.New("wit.ai: bad request")
+	ErrUnauthorized = errors.New("wit.ai: unauthorized")
+	ErrNotFound     = errors.New("wit.ai: not found")
+	ErrRateLimited  = errors.New("wit.ai: rate limited")
+	ErrServer       = errors.New("wit.ai: server error")
+)
+
+// Error returned when the API responds with a non-2xx status.  Code is the
+// HTTP status.  WitCode and Message are read from the wit.ai error body, if
+// it has one.  Reset is when a rate limit resets, if the response said.
+type ResponseError struct {
+	Body    string
+	Code    int
+	WitCode string
+	Message string
+	Reset   time.Time
+}
+
+func NewResponseError(code int, body string) ResponseError {
+	return newResponseError(code, nil, []byte(body))
+}
+
+func newResponseError(code int, header http.Header, body []byte) (e ResponseError) {
+	var data struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	e = ResponseError{Code: code, Body: string(body)}
+	if json.Unmarshal(body, &data) == nil {
+		e.WitCode = data.Code
+		e.Message = data.Error
+	}
+	if header != nil {
+		e.Reset = parseRetryAfter(header.Get("Retry-After"))
+	}
+	return
+}
+
+// Accepts either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Time {
+	var (
+		seconds int
+		t       time.Time
+		err     error
+	)
+	if value == "" {
+		return time.Time{}
+	}
+	if seconds, err = strconv.Atoi(value); err == nil {
+		return time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	if t, err = http.ParseTime(value); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+func (e ResponseError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("wit.ai responded with code %d (%v): %v", e.Code, e.WitCode, e.Message)
+	}
+	return fmt.Sprintf("Unable to handle response with code %d: `%v`", e.Code, e.Body)
+}
+
+// Returns the kind of error, one of the Err variables, or nil.
+func (e ResponseError) Kind() error {
+	switch {
+	case e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden:
+		return ErrUnauthorized
+	case e.Code == http.StatusNotFound:
+		return ErrNotFound
+	case e.Code == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.Code >= 500:
+		return ErrServer
+	case e.Code >= 400:
+		return ErrBadRequest
+	}
+	return nil
+}
+
+func (e ResponseError) Is(target error) bool {
+	return target != nil && target == e.Kind()
+}
+
+// Returns true if the same request may succeed later: rate limits and server
+// errors.
+func (e ResponseError) Retryable() bool {
+	switch e.Kind() {
+	case ErrRateLimited, ErrServer:
+		return true
+	}
+	return false
+}
+
+// Returns how long to wait before retrying, or zero if the response did not
+// say.
+func (e ResponseError) RetryAfter() time.Duration {
+	if e.Reset.IsZero() {
+		return 0
+	}
+	if d := time.Until(e.Reset); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Returns true if err is worth retrying: a retryable ResponseError or a
+// network timeout.
+func IsRetryable(err error) bool {
+	var (
+		respErr ResponseError
+		netErr  net.Error
+	)
+	if errors.As(err, &respErr) {
+		return respErr.Retryable()
+	}
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+	return false
+}
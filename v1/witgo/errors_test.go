@@ -0,0 +1,149 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	var (
+		date  = time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+		start = time.Now()
+		got   time.Time
+	)
+	if got = parseRetryAfter("120"); got.Before(start.Add(120*time.Second)) || got.After(time.Now().Add(120*time.Second)) {
+		t.Errorf("seconds: got %v, want 120s from now", got)
+	}
+	if got = parseRetryAfter(date.Format(http.TimeFormat)); !got.Equal(date) {
+		t.Errorf("HTTP date: got %v, want %v", got, date)
+	}
+	for _, value := range []string{"", "soon", "-1.5"} {
+		if got = parseRetryAfter(value); !got.IsZero() {
+			t.Errorf("%q: got %v, want zero", value, got)
+		}
+	}
+}
+
+func TestResponseErrorKind(t *testing.T) {
+	var tests = []struct {
+		code      int
+		kind      error
+		retryable bool
+	}{
+		{200, nil, false},
+		{400, ErrBadRequest, false},
+		{401, ErrUnauthorized, false},
+		{403, ErrUnauthorized, false},
+		{404, ErrNotFound, false},
+		{409, ErrBadRequest, false},
+		{429, ErrRateLimited, true},
+		{500, ErrServer, true},
+		{503, ErrServer, true},
+	}
+	for _, test := range tests {
+		var e = NewResponseError(test.code, "")
+		if e.Kind() != test.kind {
+			t.Errorf("%v: got kind %v, want %v", test.code, e.Kind(), test.kind)
+		}
+		if test.kind != nil && !errors.Is(fmt.Errorf("wrapped: %w", e), test.kind) {
+			t.Errorf("%v: Expected errors.Is to match %v", test.code, test.kind)
+		}
+		if e.Retryable() != test.retryable {
+			t.Errorf("%v: got retryable %v, want %v", test.code, e.Retryable(), test.retryable)
+		}
+	}
+}
+
+func TestNewResponseErrorReadsWitBody(t *testing.T) {
+	var e = NewResponseError(400, `{"error": "Bad request", "code": "bad-request"}`)
+	if e.WitCode != "bad-request" || e.Message != "Bad request" {
+		t.Errorf("got code %q and message %q", e.WitCode, e.Message)
+	}
+	if e = NewResponseError(502, "<html>Bad gateway</html>"); e.WitCode != "" || e.Message != "" {
+		t.Errorf("Expected a non-JSON body to leave code and message empty, got %+v", e)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	var timeout = &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	var tests = []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", NewResponseError(503, ""), true},
+		{"wrapped rate limit", fmt.Errorf("converse: %w", NewResponseError(429, "")), true},
+		{"bad request", NewResponseError(400, ""), false},
+		{"network timeout", timeout, true},
+		{"client timeout", &url.Error{Op: "Get", URL: "https://api.wit.ai", Err: timeout}, true},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, false},
+		{"other", errors.New("failed"), false},
+	}
+	for _, test := range tests {
+		if got := IsRetryable(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestResponseParse(t *testing.T) {
+	var tests = []struct {
+		name   string
+		code   int
+		header http.Header
+		body   string
+		want   string
+		err    error
+	}{
+		{name: "ok", code: 200, body: `{"_text": "hi"}`, want: "hi"},
+		{name: "created", code: 201, body: `{"_text": "hi"}`, want: "hi"},
+		{name: "no content", code: 204, want: "unchanged"},
+		{name: "empty body", code: 200, body: " \n", want: "unchanged"},
+		{name: "server error", code: 503, header: http.Header{"Retry-After": {"5"}}, body: "down", want: "unchanged", err: ErrServer},
+	}
+	for _, test := range tests {
+		var (
+			out = MessageResponse{Text: "unchanged"}
+			r   = Response{
+				StatusCode: test.code,
+				Header:     test.header,
+				Body:       ioutil.NopCloser(strings.NewReader(test.body)),
+			}
+			err = r.Parse(&out)
+		)
+		if test.err == nil && err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		} else if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%v: got error %v, want %v", test.name, err, test.err)
+		}
+		if out.Text != test.want {
+			t.Errorf("%v: got %q, want %q", test.name, out.Text, test.want)
+		}
+		var respErr ResponseError
+		if test.header != nil && (!errors.As(err, &respErr) || respErr.RetryAfter() <= 0) {
+			t.Errorf("%v: Expected the Retry-After header to be read, got %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// The Context key holding the current state of a Flow.
+const FLOW_STATE = "_state"
+
+// Leaves a state when its conditions hold.  A transition without an intent
+// or entities always matches.
+type FlowTransition struct {
+	// The intent the message must have.
+	Intent string `json:"intent,omitempty" yaml:"intent,omitempty"`
+	// Entities which must all be present in the message.
+	Entities []string `json:"entities,omitempty" yaml:"entities,omitempty"`
+	// Context keys to set from entities, mapped to the entity key.
+	Set map[string]string `json:"set,omitempty" yaml:"set,omitempty"`
+	// The state to enter.
+	To string `json:"to" yaml:"to"`
+}
+
+type FlowState struct {
+	// Passed to Handler.Action when the state is entered.
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+	// Templates said in order when the state is entered, after the action.
+	// They are executed with text/template against Session.Context.
+	Say []string `json:"say,omitempty" yaml:"say,omitempty"`
+	// Checked in order against every message received in the state.
+	Transitions []*FlowTransition `json:"transitions,omitempty" yaml:"transitions,omitempty"`
+	// Entered straight after this state without waiting for a message.
+	Next string `json:"next,omitempty" yaml:"next,omitempty"`
+
+	templates []*template.Template
+	sources   []string
+}
+
+// A finite-state conversation flow, driven by the intents and entities of
+// the /message endpoint.  Flows are usually loaded from a file:
+//
+//	{
+//	  "start": "idle",
+//	  "states": {
+//	    "idle": {"transitions": [
+//	      {"intent": "weather", "entities": ["location"], "set": {"loc": "location"}, "to": "forecast"},
+//	      {"intent": "weather", "to": "ask"}
+//	    ]},
+//	    "ask": {"say": ["Where?"], "transitions": [
+//	      {"entities": ["location"], "set": {"loc": "location"}, "to": "forecast"}
+//	    ]},
+//	    "forecast": {"action": "getForecast", "say": ["It's {{.forecast}} in {{.loc}}."], "next": "idle"}
+//	  }
+//	}
+//
+// A session starts in the start state without entering it.  Each message is
+// matched against the transitions of the current state; if none match, the
+// fallback is said and the state is kept.  Flow implements Engine.
+type Flow struct {
+	Start    string                `json:"start" yaml:"start"`
+	States   map[string]*FlowState `json:"states" yaml:"states"`
+	Fallback string                `json:"fallback,omitempty" yaml:"fallback,omitempty"`
+	// Intents and entities with a lower confidence are ignored.
+	MinConfidence float64 `json:"min_confidence,omitempty" yaml:"min_confidence,omitempty"`
+
+	mu sync.Mutex
+}
+
+// Lists every problem found validating a Flow.
+type FlowError struct {
+	Problems []string
+}
+
+func (e *FlowError) Error() string {
+	return fmt.Sprintf("Invalid flow: %v", strings.Join(e.Problems, "; "))
+}
+
+// Decodes and validates a flow.  A nil unmarshal decodes JSON; pass a
+// function such as yaml.Unmarshal to decode other formats.  If actions are
+// given, every action of the flow must be among them, see Validate.
+func ParseFlow(data []byte, unmarshal func([]byte, interface{}) error, actions ...string) (flow *Flow, err error) {
+	if unmarshal == nil {
+		unmarshal = json.Unmarshal
+	}
+	flow = &Flow{}
+	if err = unmarshal(data, flow); err != nil {
+		flow = nil
+		return
+	}
+	if err = flow.Validate(actions...); err != nil {
+		flow = nil
+	}
+	return
+}
+
+// Reads the flow stored at path, see ParseFlow.
+func LoadFlow(path string, unmarshal func([]byte, interface{}) error, actions ...string) (flow *Flow, err error) {
+	var data []byte
+	if data, err = os.ReadFile(path); err != nil {
+		return
+	}
+	return ParseFlow(data, unmarshal, actions...)
+}
+
+// Checks that every state referenced exists and can be reached from the
+// start state, that no states loop through Next, and compiles the templates
+// of every state.  If actions are given, every action of the flow must be
+// among them.  Returns a *FlowError.  Flows which are not validated compile
+// their templates when a state is first entered.
+func (f *Flow) Validate(actions ...string) (err error) {
+	var (
+		problems []string
+		known    = map[string]bool{}
+		reached  = map[string]bool{}
+		queue    []string
+		names    []string
+		name     string
+		state    *FlowState
+		found    bool
+		next     string
+		chain    map[string]bool
+		looped   = map[string]bool{}
+		parseErr error
+	)
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	for _, action := range actions {
+		known[action] = true
+	}
+	for name = range f.States {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if _, found = f.States[f.Start]; !found {
+		problem("start state %q does not exist", f.Start)
+	}
+	for _, name = range names {
+		if state = f.States[name]; state == nil {
+			problem("state %q is empty", name)
+			continue
+		}
+		if state.Next != "" {
+			if _, found = f.States[state.Next]; !found {
+				problem("state %q has next state %q which does not exist", name, state.Next)
+			}
+		}
+		for i, transition := range state.Transitions {
+			if _, found = f.States[transition.To]; !found {
+				problem("transition %v of state %q leads to %q which does not exist", i, name, transition.To)
+			}
+		}
+		if state.Action != "" && len(actions) > 0 && !known[state.Action] {
+			problem("state %q runs action %q which has no handler", name, state.Action)
+		}
+		f.mu.Lock()
+		state.templates = nil
+		_, parseErr = f.compileLocked(name, state)
+		f.mu.Unlock()
+		if parseErr != nil {
+			problem("state %q: %v", name, parseErr)
+		}
+		chain = map[string]bool{}
+		for next = name; next != "" && f.States[next] != nil && !looped[next]; next = f.States[next].Next {
+			if chain[next] {
+				problem("state %q loops through next", next)
+				break
+			}
+			chain[next] = true
+		}
+		for next = range chain {
+			looped[next] = true
+		}
+	}
+	if state, found = f.States[f.Start]; found && state != nil {
+		reached[f.Start] = true
+		queue = append(queue, f.Start)
+	}
+	for len(queue) > 0 {
+		state, queue = f.States[queue[0]], queue[1:]
+		if state == nil {
+			continue
+		}
+		targets := []string{state.Next}
+		for _, transition := range state.Transitions {
+			targets = append(targets, transition.To)
+		}
+		for _, target := range targets {
+			if _, found = f.States[target]; found && !reached[target] {
+				reached[target] = true
+				queue = append(queue, target)
+			}
+		}
+	}
+	for _, name = range names {
+		if !reached[name] && f.States[f.Start] != nil {
+			problem("state %q is unreachable", name)
+		}
+	}
+	if len(problems) > 0 {
+		err = &FlowError{Problems: problems}
+	}
+	return
+}
+
+// Returns the first transition of state matching the message.
+func (f *Flow) match(state *FlowState, intent string, entities EntityMap) *FlowTransition {
+	var matched bool
+	for _, transition := range state.Transitions {
+		if transition.Intent != "" && transition.Intent != intent {
+			continue
+		}
+		matched = true
+		for _, key := range transition.Entities {
+			if len(entities.AboveThreshold(key, f.MinConfidence)) == 0 {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return transition
+		}
+	}
+	return nil
+}
+
+// Returns true if the Say templates of a state were compiled from its
+// current text.
+func (s *FlowState) compiled() bool {
+	if s.templates == nil || len(s.sources) != len(s.Say) {
+		return false
+	}
+	for i, text := range s.Say {
+		if s.sources[i] != text {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the compiled Say templates of a state, compiling them if the state
+// has changed since.  Must be called with f.mu held.
+func (f *Flow) compileLocked(name string, state *FlowState) (templates []*template.Template, err error) {
+	var tmpl *template.Template
+	if state.compiled() {
+		return state.templates, nil
+	}
+	for i, text := range state.Say {
+		if tmpl, err = parseTemplate(fmt.Sprintf("%v.say.%v", name, i), text); err != nil {
+			return nil, err
+		}
+		templates = append(templates, tmpl)
+	}
+	state.templates = templates
+	state.sources = append([]string{}, state.Say...)
+	return
+}
+
+func (f *Flow) compile(name string, state *FlowState) ([]*template.Template, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.compileLocked(name, state)
+}
+
+// Enters a state and any states following it through Next.
+func (f *Flow) enter(steps Steps, session *Session, name string, entities EntityMap) (out *Session, err error) {
+	var (
+		state     *FlowState
+		found     bool
+		templates []*template.Template
+		buf       bytes.Buffer
+		entered   int
+	)
+	out = session
+	for name != "" {
+		if entered++; entered > len(f.States) {
+			err = fmt.Errorf("Flow loops through state %q", name)
+			return
+		}
+		if state, found = f.States[name]; !found || state == nil {
+			err = fmt.Errorf("Flow has no state %q", name)
+			return
+		}
+		if templates, err = f.compile(name, state); err != nil {
+			return
+		}
+		out.Context.Set(FLOW_STATE, name)
+		if state.Action != "" {
+			if out, err = steps.Action(out, entities, state.Action); err != nil {
+				return
+			}
+		}
+		for _, tmpl := range templates {
+			buf.Reset()
+			if err = tmpl.Execute(&buf, out.Context); err != nil {
+				return
+			}
+			if out, err = steps.Say(out, buf.String()); err != nil {
+				return
+			}
+		}
+		name = state.Next
+	}
+	return
+}
+
+func (f *Flow) Turn(steps Steps, session *Session, q string) (out *Session, err error) {
+	var (
+		response   *MessageResponse
+		intent     string
+		confidence float64
+		current    string
+		state      *FlowState
+		found      bool
+		transition *FlowTransition
+		matches    []*Entity
+	)
+	if response, err = steps.Message(q); err != nil {
+		return
+	}
+	if intent, confidence = response.Intent(); confidence < f.MinConfidence {
+		intent = ""
+	}
+	if current, _ = session.Context.Get(FLOW_STATE).(string); current == "" {
+		current = f.Start
+	}
+	if state, found = f.States[current]; !found || state == nil {
+		err = fmt.Errorf("Flow has no state %q", current)
+		return
+	}
+	if transition = f.match(state, intent, response.Entities); transition == nil {
+		out = session
+		if f.Fallback != "" {
+			out, err = steps.Say(session, f.Fallback)
+		}
+		return
+	}
+	for key, entity := range transition.Set {
+		if matches = response.Entities.AboveThreshold(entity, f.MinConfidence); len(matches) > 0 {
+			session.Context.Set(key, matches[0].Value)
+		}
+	}
+	return f.enter(steps, session, transition.To, response.Entities)
+}
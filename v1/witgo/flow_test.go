@@ -0,0 +1,217 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo_test
+
+import (
+	"errors"
+	"github.com/kurrik/witgo/v1/witgo"
+	"github.com/kurrik/witgo/v1/witgo/witgotest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFlowValidate(t *testing.T) {
+	var tests = []struct {
+		name    string
+		flow    *witgo.Flow
+		actions []string
+		want    []string
+	}{
+		{
+			name: "valid",
+			flow: &witgo.Flow{Start: "a", States: map[string]*witgo.FlowState{
+				"a": {Transitions: []*witgo.FlowTransition{{To: "b"}}},
+				"b": {Action: "act", Say: []string{"{{.x}}"}, Next: "a"},
+			}},
+			actions: []string{"act"},
+		},
+		{
+			name: "missing states",
+			flow: &witgo.Flow{Start: "x", States: map[string]*witgo.FlowState{
+				"a": {Next: "y", Transitions: []*witgo.FlowTransition{{To: "z"}}},
+			}},
+			want: []string{
+				`start state "x" does not exist`,
+				`state "a" has next state "y" which does not exist`,
+				`transition 0 of state "a" leads to "z" which does not exist`,
+			},
+		},
+		{
+			name: "unreachable",
+			flow: &witgo.Flow{Start: "a", States: map[string]*witgo.FlowState{
+				"a": {},
+				"b": {},
+			}},
+			want: []string{`state "b" is unreachable`},
+		},
+		{
+			name: "next cycle",
+			flow: &witgo.Flow{Start: "a", States: map[string]*witgo.FlowState{
+				"a": {Transitions: []*witgo.FlowTransition{{To: "b"}}},
+				"b": {Next: "c"},
+				"c": {Next: "d"},
+				"d": {Next: "b"},
+			}},
+			want: []string{`state "b" loops through next`},
+		},
+		{
+			name: "self loop",
+			flow: &witgo.Flow{Start: "a", States: map[string]*witgo.FlowState{
+				"a": {Next: "a"},
+			}},
+			want: []string{`state "a" loops through next`},
+		},
+		{
+			name: "bad template",
+			flow: &witgo.Flow{Start: "a", States: map[string]*witgo.FlowState{
+				"a": {Say: []string{"{{.x"}},
+			}},
+			want: []string{`state "a": `},
+		},
+		{
+			name: "missing action",
+			flow: &witgo.Flow{Start: "a", States: map[string]*witgo.FlowState{
+				"a": {Action: "other"},
+			}},
+			actions: []string{"act"},
+			want:    []string{`state "a" runs action "other" which has no handler`},
+		},
+	}
+	for _, test := range tests {
+		var (
+			err      = test.flow.Validate(test.actions...)
+			flowErr  *witgo.FlowError
+			problems []string
+		)
+		if err != nil && !errors.As(err, &flowErr) {
+			t.Errorf("%v: got error %v, want a *FlowError", test.name, err)
+			continue
+		}
+		if flowErr != nil {
+			problems = flowErr.Problems
+		}
+		if len(problems) != len(test.want) {
+			t.Errorf("%v: got problems %q, want %q", test.name, problems, test.want)
+			continue
+		}
+		for i, want := range test.want {
+			if !strings.HasPrefix(problems[i], want) {
+				t.Errorf("%v: got problem %q, want %q", test.name, problems[i], want)
+			}
+		}
+	}
+}
+
+func TestFlowWithoutValidate(t *testing.T) {
+	var (
+		server  = witgotest.NewServer()
+		handler = witgotest.NewMockHandler()
+		flow    = &witgo.Flow{Start: "idle", States: map[string]*witgo.FlowState{
+			"idle": {Transitions: []*witgo.FlowTransition{
+				{Intent: "weather", Entities: []string{"location"}, Set: map[string]string{"loc": "location"}, To: "forecast"},
+			}},
+			"forecast": {Action: "getForecast", Say: []string{"It's {{.forecast}} in {{.loc}}."}, Next: "idle"},
+		}}
+		conv *witgotest.Conversation
+	)
+	defer server.Close()
+	server.AddMessage("Weather in Paris?", &witgo.MessageResponse{
+		Intents:  []*witgo.MessageIntent{{Name: "weather", Confidence: 1}},
+		Entities: witgo.EntityMap{"location": {{Value: "Paris", Confidence: 1}}},
+	})
+	handler.OnAction("getForecast", witgotest.MockResult{Set: witgo.Context{"forecast": "sunny"}})
+	conv = witgotest.NewConversation(server.Client, handler)
+	conv.Engine = flow
+	conv.User("Weather in Paris?").
+		ExpectAction("getForecast", "location=Paris").
+		ExpectSay("It's sunny in Paris.").
+		ExpectContext("loc", "Paris").
+		ExpectContext(witgo.FLOW_STATE, "idle")
+	if _, err := conv.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlowReportsBadTemplateWithoutValidate(t *testing.T) {
+	var (
+		server  = witgotest.NewServer()
+		handler = witgotest.NewMockHandler()
+		flow    = &witgo.Flow{Start: "idle", States: map[string]*witgo.FlowState{
+			"idle":   {Transitions: []*witgo.FlowTransition{{To: "broken"}}},
+			"broken": {Say: []string{"{{.x"}},
+		}}
+		input = witgotest.NewScriptedQueries("s", "hello")
+		wg    = witgo.NewWitgo(server.Client, handler)
+	)
+	defer server.Close()
+	server.AddMessage("hello", &witgo.MessageResponse{})
+	wg.Engine = flow
+	if err := wg.Process(input); err != nil {
+		t.Fatal(err)
+	}
+	if turns := input.Turns(); len(turns) != 1 || turns[0].Err == nil {
+		t.Fatalf("Expected the turn to fail parsing the template, got %+v", turns)
+	}
+}
+
+func TestParseFlowChecksActions(t *testing.T) {
+	var (
+		data  = []byte(`{"start": "idle", "states": {"idle": {"action": "getForecast"}}}`)
+		path  = filepath.Join(t.TempDir(), "flow.json")
+		tests = []struct {
+			actions []string
+			err     bool
+		}{
+			{nil, false},
+			{[]string{"getForecast", "other"}, false},
+			{[]string{"other"}, true},
+		}
+	)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		var flow, err = witgo.ParseFlow(data, nil, test.actions...)
+		if (err != nil) != test.err || (flow == nil) != test.err {
+			t.Errorf("ParseFlow %v: got flow %v and error %v", test.actions, flow, err)
+		}
+		if flow, err = witgo.LoadFlow(path, nil, test.actions...); (err != nil) != test.err || (flow == nil) != test.err {
+			t.Errorf("LoadFlow %v: got flow %v and error %v", test.actions, flow, err)
+		}
+	}
+}
+
+func TestFlowRecompilesChangedSay(t *testing.T) {
+	var (
+		server = witgotest.NewServer()
+		flow   = &witgo.Flow{Start: "idle", States: map[string]*witgo.FlowState{
+			"idle":  {Transitions: []*witgo.FlowTransition{{To: "greet"}}},
+			"greet": {Say: []string{"Hello!"}, Next: "idle"},
+		}}
+		conv *witgotest.Conversation
+	)
+	defer server.Close()
+	for _, say := range []string{"Hello!", "Bye!"} {
+		flow.States["greet"].Say[0] = say
+		conv = witgotest.NewConversation(server.Client, witgotest.NewMockHandler())
+		conv.Engine = flow
+		conv.User("Hi").ExpectSay(say)
+		if _, err := conv.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -18,39 +18,110 @@ package witgo
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 )
 
+// A query read by an Input.  ID and Position are optional and only used by
+// inputs which support checkpoints: ID identifies the record for
+// deduplication and Position is where to resume reading after it.
+// Locale is optional and, if set, is copied to the session.
 type InputRecord struct {
 	SessionID
-	Query string
+	Query    string
+	ID       string
+	Position string
+	Locale   string
 }
 
+// Sent to an Input once Witgo has finished processing one of its records.
+// Messages holds every message the bot said during the turn, in order.
+// Err is set if the turn could not be completed.  Duplicate is set if the
+// record had already been processed and was skipped.
+type Turn struct {
+	InputRecord
+	Messages  []string
+	Err       error
+	Duplicate bool
+}
+
+// Produces records for Witgo to process.
+//
+// Witgo owns turns and sends exactly one Turn for every record it reads, in
+// the order the records were read.  Sends are blocking, so an Input must keep
+// receiving from turns until Witgo closes it.
+//
+// To shut down, an Input closes records.  Witgo finishes the record in flight,
+// delivers its Turn and then closes turns.  Once turns is closed it is safe for
+// the Input to exit.
 type Input interface {
-	Run() (requests chan<- SessionID, records <-chan InputRecord)
+	Run(turns <-chan Turn) (records <-chan InputRecord)
+}
+
+// Implemented by Inputs which resume from a checkpoint.  Witgo commits each
+// record to the Checkpointer once its turn has finished, unless it failed with
+// a retryable error, and skips records which were already committed.
+type CheckpointedInput interface {
+	Input
+	Checkpointer() *Checkpointer
 }
 
+// Implemented by Inputs which queue records before sending them, such as
+// messages fetched but not yet sent.  Backlog returns the number of records
+// queued behind the last one sent.
+type BacklogInput interface {
+	Input
+	Backlog() int
+}
+
+// Reads queries from In and writes prompts and messages to Out, which default
+// to the process's stdin and stdout.
 type InteractiveInput struct {
+	In  io.Reader
+	Out io.Writer
 }
 
 func NewInteractiveInput() *InteractiveInput {
-	return &InteractiveInput{}
+	return &InteractiveInput{
+		In:  os.Stdin,
+		Out: os.Stdout,
+	}
+}
+
+// Returns In, or os.Stdin if it is nil.
+func (i *InteractiveInput) in() io.Reader {
+	if i.In == nil {
+		return os.Stdin
+	}
+	return i.In
+}
+
+// Returns Out, or os.Stdout if it is nil.
+func (i *InteractiveInput) out() io.Writer {
+	if i.Out == nil {
+		return os.Stdout
+	}
+	return i.Out
 }
 
-func (i *InteractiveInput) run(requests <-chan SessionID, records chan<- InputRecord) {
+func (i *InteractiveInput) run(turns <-chan Turn, records chan<- InputRecord) {
 	var (
 		reader  *bufio.Reader
-		session SessionID
+		session SessionID = "interactive"
+		turn    Turn
 		line    string
 		err     error
 	)
-	reader = bufio.NewReader(os.Stdin)
-	defer close(records)
-	fmt.Printf("Interactive mode (use ':quit' to stop)\n")
+	reader = bufio.NewReader(i.in())
+	defer func() {
+		close(records)
+		for range turns {
+		}
+	}()
+	fmt.Fprintf(i.out(), "Interactive mode (use ':quit' to stop)\n")
 	for true {
-		session = <-requests
-		fmt.Printf("%v> ", session)
+		fmt.Fprintf(i.out(), "%v> ", session)
 		if line, err = reader.ReadString('\n'); err != nil {
 			return
 		}
@@ -61,16 +132,21 @@ func (i *InteractiveInput) run(requests <-chan SessionID, records chan<- InputRe
 			SessionID: session,
 			Query:     line,
 		}
+		if turn = <-turns; turn.Err != nil {
+			fmt.Fprintf(i.out(), "Error: %v\n", turn.Err)
+		}
 	}
 	return
 }
 
-func (i *InteractiveInput) Run() (chan<- SessionID, <-chan InputRecord) {
-	var (
-		requests = make(chan SessionID)
-		records  = make(chan InputRecord)
-	)
-	go i.run(requests, records)
-	requests <- "interactive" // Start interactive loop.
-	return requests, records
+// Prints messages said by the bot.
+func (i *InteractiveInput) Respond(sessionID SessionID, msg string) (err error) {
+	_, err = fmt.Fprintf(i.out(), "< %v\n", msg)
+	return
+}
+
+func (i *InteractiveInput) Run(turns <-chan Turn) <-chan InputRecord {
+	var records = make(chan InputRecord)
+	go i.run(turns, records)
+	return records
 }
@@ -0,0 +1,51 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInteractiveInputDefaults(t *testing.T) {
+	var input InteractiveInput
+	if input.in() != os.Stdin || input.out() != os.Stdout {
+		t.Fatal("Expected a zero InteractiveInput to use stdin and stdout")
+	}
+}
+
+func TestInteractiveInputRun(t *testing.T) {
+	var (
+		out   bytes.Buffer
+		input = &InteractiveInput{In: strings.NewReader("hello\n:quit\n"), Out: &out}
+		turns = make(chan Turn)
+	)
+	records := input.Run(turns)
+	record := <-records
+	if record.Query != "hello\n" || record.SessionID != "interactive" {
+		t.Fatalf("Unexpected record %+v", record)
+	}
+	input.Respond(record.SessionID, "hi")
+	turns <- Turn{InputRecord: record}
+	if _, ok := <-records; ok {
+		t.Fatal("Expected records to close on :quit")
+	}
+	close(turns)
+	if !strings.Contains(out.String(), "< hi\n") {
+		t.Fatalf("Expected response in output, got %q", out.String())
+	}
+}
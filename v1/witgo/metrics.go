@@ -0,0 +1,285 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receives measurements from Client and Witgo.  Implementations must be safe
+// for concurrent use.
+type Metrics interface {
+	// Called after every API request.  Status is zero if no response was
+	// received.
+	ObserveRequest(endpoint string, status int, latency time.Duration)
+	// Called after every turn with the number of converse steps it took.
+	ObserveTurn(steps int, err error)
+	// Called after every Handler action.
+	ObserveAction(action string, duration time.Duration, err error)
+	// Called after every turn with the number of sessions Witgo keeps, see
+	// Witgo.SessionTTL.
+	SetActiveSessions(count int)
+	// Called after every record read with the number of records waiting in
+	// the input, see BacklogInput.  Inputs which do not implement it report
+	// the records buffered in their channel.
+	SetInputBacklog(count int)
+}
+
+var (
+	DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	DefaultStepBuckets    = []float64{1, 2, 3, 5, 8, 13, 21}
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// A metric series: a name and a set of label pairs, such as
+// `endpoint="/message",status="200"`.
+type series struct {
+	name   string
+	labels string
+}
+
+// Escapes label values as the Prometheus text format requires: only
+// backslashes, double quotes and line feeds.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%v="%v"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Keeps metrics in memory and exposes them through expvar and in the
+// Prometheus text format.
+type ExpvarMetrics struct {
+	LatencyBuckets []float64
+	StepBuckets    []float64
+
+	mu         sync.Mutex
+	counters   map[series]uint64
+	gauges     map[series]float64
+	histograms map[series]*histogram
+}
+
+// Creates metrics published to expvar under name, if name is not empty.
+// Like expvar.Publish, panics if name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	var m = &ExpvarMetrics{
+		LatencyBuckets: DefaultLatencyBuckets,
+		StepBuckets:    DefaultStepBuckets,
+		counters:       map[series]uint64{},
+		gauges:         map[series]float64{},
+		histograms:     map[series]*histogram{},
+	}
+	if name != "" {
+		expvar.Publish(name, expvar.Func(m.snapshot))
+	}
+	return m
+}
+
+func (m *ExpvarMetrics) add(s series, delta uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[s] += delta
+}
+
+func (m *ExpvarMetrics) set(s series, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[s] = v
+}
+
+func (m *ExpvarMetrics) observe(s series, buckets []float64, v float64) {
+	var (
+		h     *histogram
+		found bool
+	)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, found = m.histograms[s]; !found {
+		h = newHistogram(buckets)
+		m.histograms[s] = h
+	}
+	h.observe(v)
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func (m *ExpvarMetrics) ObserveRequest(endpoint string, status int, latency time.Duration) {
+	var l = labels("endpoint", endpoint, "status", strconv.Itoa(status))
+	m.add(series{"witgo_requests_total", l}, 1)
+	m.observe(series{"witgo_request_duration_seconds", l}, m.LatencyBuckets, latency.Seconds())
+}
+
+func (m *ExpvarMetrics) ObserveTurn(steps int, err error) {
+	m.add(series{"witgo_turns_total", labels("result", result(err))}, 1)
+	m.observe(series{"witgo_converse_steps", ""}, m.StepBuckets, float64(steps))
+}
+
+func (m *ExpvarMetrics) ObserveAction(action string, duration time.Duration, err error) {
+	var l = labels("action", action, "result", result(err))
+	m.add(series{"witgo_actions_total", l}, 1)
+	m.observe(series{"witgo_action_duration_seconds", labels("action", action)}, m.LatencyBuckets, duration.Seconds())
+}
+
+func (m *ExpvarMetrics) SetActiveSessions(count int) {
+	m.set(series{"witgo_active_sessions", ""}, float64(count))
+}
+
+func (m *ExpvarMetrics) SetInputBacklog(count int) {
+	m.set(series{"witgo_input_backlog", ""}, float64(count))
+}
+
+func seriesKey(s series) string {
+	if s.labels == "" {
+		return s.name
+	}
+	return s.name + "{" + s.labels + "}"
+}
+
+// Returns the metrics as a map for expvar.
+func (m *ExpvarMetrics) snapshot() interface{} {
+	var out = map[string]interface{}{}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for s, v := range m.counters {
+		out[seriesKey(s)] = v
+	}
+	for s, v := range m.gauges {
+		out[seriesKey(s)] = v
+	}
+	for s, h := range m.histograms {
+		out[seriesKey(s)] = map[string]interface{}{
+			"count":   h.count,
+			"sum":     h.sum,
+			"buckets": h.buckets,
+			"counts":  append([]uint64{}, h.counts...),
+		}
+	}
+	return out
+}
+
+func withLabel(l string, pair string) string {
+	if l == "" {
+		return "{" + pair + "}"
+	}
+	return "{" + l + "," + pair + "}"
+}
+
+func braces(l string) string {
+	if l == "" {
+		return ""
+	}
+	return "{" + l + "}"
+}
+
+// Writes every metric in the Prometheus text exposition format.
+func (m *ExpvarMetrics) WritePrometheus(w io.Writer) {
+	type entry struct {
+		labels string
+		lines  []string
+	}
+	var (
+		entries = map[string][]entry{}
+		types   = map[string]string{}
+		names   []string
+	)
+	m.mu.Lock()
+	for s, v := range m.counters {
+		types[s.name] = "counter"
+		entries[s.name] = append(entries[s.name], entry{s.labels, []string{
+			fmt.Sprintf("%v%v %v", s.name, braces(s.labels), v),
+		}})
+	}
+	for s, v := range m.gauges {
+		types[s.name] = "gauge"
+		entries[s.name] = append(entries[s.name], entry{s.labels, []string{
+			fmt.Sprintf("%v%v %v", s.name, braces(s.labels), v),
+		}})
+	}
+	for s, h := range m.histograms {
+		var e = entry{labels: s.labels}
+		types[s.name] = "histogram"
+		for i, bound := range h.buckets {
+			e.lines = append(e.lines, fmt.Sprintf("%v_bucket%v %v",
+				s.name, withLabel(s.labels, labels("le", strconv.FormatFloat(bound, 'g', -1, 64))), h.counts[i]))
+		}
+		e.lines = append(e.lines,
+			fmt.Sprintf("%v_bucket%v %v", s.name, withLabel(s.labels, `le="+Inf"`), h.count),
+			fmt.Sprintf("%v_sum%v %v", s.name, braces(s.labels), h.sum),
+			fmt.Sprintf("%v_count%v %v", s.name, braces(s.labels), h.count),
+		)
+		entries[s.name] = append(entries[s.name], e)
+	}
+	m.mu.Unlock()
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sort.Slice(entries[name], func(i, j int) bool { return entries[name][i].labels < entries[name][j].labels })
+		fmt.Fprintf(w, "# TYPE %v %v\n", name, types[name])
+		for _, e := range entries[name] {
+			for _, line := range e.lines {
+				fmt.Fprintln(w, line)
+			}
+		}
+	}
+}
+
+// Returns a handler serving the metrics in the Prometheus text format.
+func (m *ExpvarMetrics) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WritePrometheus(w)
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLabelsEscaping(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  string
+	}{
+		{"plain", `k="plain"`},
+		{`a\b`, `k="a\\b"`},
+		{`say "hi"`, `k="say \"hi\""`},
+		{"two\nlines", `k="two\nlines"`},
+		{"tab\tand é", "k=\"tab\tand é\""},
+	}
+	for _, test := range tests {
+		if got := labels("k", test.value); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var (
+		m    = NewExpvarMetrics("")
+		buf  = &bytes.Buffer{}
+		want = `# TYPE witgo_action_duration_seconds histogram
+witgo_action_duration_seconds_bucket{action="say \"é\"",le="0.1"} 1
+witgo_action_duration_seconds_bucket{action="say \"é\"",le="1"} 2
+witgo_action_duration_seconds_bucket{action="say \"é\"",le="+Inf"} 2
+witgo_action_duration_seconds_sum{action="say \"é\""} 0.55
+witgo_action_duration_seconds_count{action="say \"é\""} 2
+# TYPE witgo_actions_total counter
+witgo_actions_total{action="say \"é\"",result="error"} 1
+witgo_actions_total{action="say \"é\"",result="ok"} 1
+# TYPE witgo_active_sessions gauge
+witgo_active_sessions 3
+# TYPE witgo_input_backlog gauge
+witgo_input_backlog 7
+# TYPE witgo_requests_total counter
+witgo_requests_total{endpoint="/message",status="200"} 1
+`
+	)
+	m.LatencyBuckets = []float64{0.1, 1}
+	m.ObserveAction(`say "é"`, 50*time.Millisecond, nil)
+	m.ObserveAction(`say "é"`, 500*time.Millisecond, errors.New("failed"))
+	m.SetActiveSessions(3)
+	m.SetInputBacklog(7)
+	m.add(series{"witgo_requests_total", labels("endpoint", "/message", "status", "200")}, 1)
+	m.WritePrometheus(buf)
+	if buf.String() != want {
+		t.Fatalf("got:\n%v\nwant:\n%v", buf, want)
+	}
+}
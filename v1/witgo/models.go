@@ -15,29 +15,146 @@
 package witgo
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"sort"
 )
 
+// Values which are not strings, such as numbers, are kept as their JSON text.
+// Raw holds the JSON the value was decoded from.  When encoding, fields
+// changed since decoding are written over Raw.
 type Value struct {
-	Expressions []string `json:expressions`
-	Value       string   `json:value`
+	Expressions []string        `json:"expressions"`
+	Value       string          `json:"value"`
+	Raw         json.RawMessage `json:"-"`
 }
 
+// Values which are not strings, such as numbers, are kept as their JSON text.
+// Raw holds the JSON the entity was decoded from.  When encoding, fields
+// changed since decoding are written over Raw.  Built-in entities can be
+// decoded from Raw with methods such as DateTime and Number.
+//
+// Confidence, Start, End, Body, Role and Suggested are set on entities
+// extracted from a message; Start and End are offsets of Body in the text.
 type Entity struct {
-	Lang    string   `json:lang`
-	Closed  bool     `json:closed`
-	Exotic  bool     `json:exotic`
-	Value   string   `json:value`
-	Values  []*Value `json:values`
-	Builtin bool     `json:builtin`
-	Doc     string   `json:doc`
-	Name    string   `json:name`
-	ID      string   `json:id`
+	Lang       string          `json:"lang"`
+	Closed     bool            `json:"closed"`
+	Exotic     bool            `json:"exotic"`
+	Value      string          `json:"value"`
+	Values     []*Value        `json:"values"`
+	Builtin    bool            `json:"builtin"`
+	Doc        string          `json:"doc"`
+	Name       string          `json:"name"`
+	ID         string          `json:"id"`
+	Confidence float64         `json:"confidence"`
+	Start      int             `json:"start"`
+	End        int             `json:"end"`
+	Body       string          `json:"body"`
+	Role       string          `json:"role"`
+	Suggested  bool            `json:"suggested"`
+	Raw        json.RawMessage `json:"-"`
+}
+
+// Returns a JSON string as a string and any other JSON value as its text.
+func rawString(raw json.RawMessage) (out string) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	if json.Unmarshal(raw, &out) != nil {
+		out = string(raw)
+	}
+	return
+}
+
+func (v *Value) UnmarshalJSON(b []byte) (err error) {
+	type plain Value
+	var aux struct {
+		*plain
+		Value json.RawMessage `json:"value"`
+	}
+	aux.plain = (*plain)(v)
+	if err = json.Unmarshal(b, &aux); err != nil {
+		return
+	}
+	v.Value = rawString(aux.Value)
+	v.Raw = append(json.RawMessage{}, b...)
+	return
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	type plain Value
+	var original Value
+	if len(v.Raw) == 0 || json.Unmarshal(v.Raw, &original) != nil {
+		return json.Marshal(plain(v))
+	}
+	return overlayRaw(v.Raw, plain(original), plain(v))
+}
+
+func (e *Entity) UnmarshalJSON(b []byte) (err error) {
+	type plain Entity
+	var aux struct {
+		*plain
+		Value json.RawMessage `json:"value"`
+	}
+	aux.plain = (*plain)(e)
+	if err = json.Unmarshal(b, &aux); err != nil {
+		return
+	}
+	e.Value = rawString(aux.Value)
+	e.Raw = append(json.RawMessage{}, b...)
+	return
+}
+
+func (e Entity) MarshalJSON() ([]byte, error) {
+	type plain Entity
+	var original Entity
+	if len(e.Raw) == 0 || json.Unmarshal(e.Raw, &original) != nil {
+		return json.Marshal(plain(e))
+	}
+	return overlayRaw(e.Raw, plain(original), plain(e))
+}
+
+// Returns raw with every field of current which differs from original, the
+// value raw was decoded into, written over it.  Changes made after decoding
+// are kept along with fields of raw which are not modeled, such as the
+// structure of built-in entity values.
+func overlayRaw(raw json.RawMessage, original interface{}, current interface{}) (out []byte, err error) {
+	var (
+		fields    map[string]json.RawMessage
+		originals map[string]json.RawMessage
+		currents  map[string]json.RawMessage
+	)
+	if json.Unmarshal(raw, &fields) != nil || fields == nil {
+		return json.Marshal(current)
+	}
+	if originals, err = jsonFields(original); err != nil {
+		return
+	}
+	if currents, err = jsonFields(current); err != nil {
+		return
+	}
+	for key, value := range currents {
+		if !bytes.Equal(value, originals[key]) {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// Returns the fields of the JSON encoding of v.
+func jsonFields(v interface{}) (fields map[string]json.RawMessage, err error) {
+	var b []byte
+	if b, err = json.Marshal(v); err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &fields)
+	return
 }
 
 type EntityMap map[string][]*Entity
 
-func (m EntityMap) FirstEntityValue(key string) (out string, err error) {
+func (m EntityMap) FirstEntity(key string) (out *Entity, err error) {
 	var (
 		entities []*Entity
 		found    bool
@@ -46,14 +163,114 @@ func (m EntityMap) FirstEntityValue(key string) (out string, err error) {
 		err = fmt.Errorf("No entities associated with key %v", key)
 		return
 	}
-	out = entities[0].Value
+	out = entities[0]
+	return
+}
+
+// Returns the entities for key in the order they were returned by wit.ai.
+func (m EntityMap) All(key string) (out []*Entity) {
+	return append(out, m[key]...)
+}
+
+// Returns the entity for key with the highest confidence.  Ties go to the
+// entity returned first.
+func (m EntityMap) Best(key string) (out *Entity, err error) {
+	var entity *Entity
+	if out, err = m.FirstEntity(key); err != nil {
+		return
+	}
+	for _, entity = range m[key][1:] {
+		if entity.Confidence > out.Confidence {
+			out = entity
+		}
+	}
+	return
+}
+
+// Returns the entities for key with a confidence of at least min, ordered
+// by decreasing confidence.
+func (m EntityMap) AboveThreshold(key string, min float64) (out []*Entity) {
+	var entity *Entity
+	for _, entity = range m[key] {
+		if entity.Confidence >= min {
+			out = append(out, entity)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Confidence > out[j].Confidence
+	})
+	return
+}
+
+// Returns a copy of the map holding only entities with a confidence of at
+// least min.  Keys left without entities are removed.
+func (m EntityMap) Filter(min float64) (out EntityMap) {
+	var (
+		key      string
+		entities []*Entity
+		entity   *Entity
+	)
+	out = EntityMap{}
+	for key, entities = range m {
+		for _, entity = range entities {
+			if entity.Confidence >= min {
+				out[key] = append(out[key], entity)
+			}
+		}
+	}
+	return
+}
+
+func (m EntityMap) FirstEntityValue(key string) (out string, err error) {
+	var entity *Entity
+	if entity, err = m.FirstEntity(key); err != nil {
+		return
+	}
+	out = entity.Value
+	return
+}
+
+type MessageIntent struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Confidence float64 `json:"confidence"`
+}
+
+type MessageResponse struct {
+	MsgID    string           `json:"msg_id"`
+	Text     string           `json:"_text"`
+	Intents  []*MessageIntent `json:"intents"`
+	Entities EntityMap        `json:"entities"`
+}
+
+// Returns the most confident intent of the message.  Intents are read from
+// Intents or, for apps which return them as entities, the "intent" entity.
+// Returns an empty name if the message has no intent.
+func (r *MessageResponse) Intent() (name string, confidence float64) {
+	var (
+		intent *MessageIntent
+		entity *Entity
+		err    error
+	)
+	for _, intent = range r.Intents {
+		if name == "" || intent.Confidence > confidence {
+			name = intent.Name
+			confidence = intent.Confidence
+		}
+	}
+	if name == "" {
+		if entity, err = r.Entities.Best("intent"); err == nil {
+			name = entity.Value
+			confidence = entity.Confidence
+		}
+	}
 	return
 }
 
 type ConverseResponse struct {
-	Type       string    `json:type`
-	Msg        string    `json:msg`
-	Action     string    `json:action`
-	Entities   EntityMap `json:entities`
-	Confidence float64   `json:confidence`
+	Type       string    `json:"type"`
+	Msg        string    `json:"msg"`
+	Action     string    `json:"action"`
+	Entities   EntityMap `json:"entities"`
+	Confidence float64   `json:"confidence"`
 }
@@ -0,0 +1,97 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEntityMarshalKeepsChanges(t *testing.T) {
+	var tests = []struct {
+		name   string
+		in     string
+		change func(e *Entity)
+		want   string
+	}{
+		{
+			name:   "unchanged keeps raw fields",
+			in:     `{"type":"value","value":42,"unit":"hour","confidence":0.9}`,
+			change: func(e *Entity) {},
+			want:   `{"confidence":0.9,"type":"value","unit":"hour","value":42}`,
+		},
+		{
+			name:   "changed confidence",
+			in:     `{"value":42,"confidence":0.9}`,
+			change: func(e *Entity) { e.Confidence = 0.5 },
+			want:   `{"confidence":0.5,"value":42}`,
+		},
+		{
+			name:   "changed value",
+			in:     `{"value":42,"grain":"day"}`,
+			change: func(e *Entity) { e.Value = "43" },
+			want:   `{"grain":"day","value":"43"}`,
+		},
+		{
+			name: "filtered values",
+			in:   `{"values":[{"value":"a","expressions":["a"]},{"value":"b","expressions":["b"]}]}`,
+			change: func(e *Entity) {
+				e.Values = e.Values[1:]
+			},
+			want: `{"values":[{"expressions":["b"],"value":"b"}]}`,
+		},
+	}
+	for _, test := range tests {
+		var (
+			entity Entity
+			b      []byte
+			err    error
+		)
+		if err = json.Unmarshal([]byte(test.in), &entity); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		test.change(&entity)
+		if b, err = json.Marshal(entity); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if string(b) != test.want {
+			t.Errorf("%v: got %s, want %s", test.name, b, test.want)
+		}
+	}
+}
+
+func TestEntityMapSelection(t *testing.T) {
+	var (
+		entities = EntityMap{"loc": {
+			{Value: "a", Confidence: 0.5},
+			{Value: "b", Confidence: 0.9},
+			{Value: "c", Confidence: 0.7},
+		}}
+		best *Entity
+		err  error
+	)
+	if best, err = entities.Best("loc"); err != nil || best.Value != "b" {
+		t.Errorf("Best = %v, %v", best, err)
+	}
+	if above := entities.AboveThreshold("loc", 0.6); len(above) != 2 || above[0].Value != "b" || above[1].Value != "c" {
+		t.Errorf("AboveThreshold = %v", above)
+	}
+	if filtered := entities.Filter(0.8); len(filtered["loc"]) != 1 {
+		t.Errorf("Filter = %v", filtered)
+	}
+	if _, err = entities.Best("missing"); err == nil {
+		t.Error("Expected an error for a missing key")
+	}
+}
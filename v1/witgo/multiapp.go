@@ -0,0 +1,217 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The wit.ai endpoints used by Witgo.  Implemented by Client and
+// MultiAppClient.
+type API interface {
+	MessageContext(ctx context.Context, msg string) (response *Response, err error)
+	MessageWithOptions(ctx context.Context, msg string, options *MessageOptions) (response *Response, err error)
+	ConverseContext(ctx context.Context, sessionID SessionID, q string, witContext interface{}) (response *Response, err error)
+}
+
+type localeKey struct{}
+
+// Returns a context which routes requests made with it to the app for locale.
+// Witgo does this for every turn of a session with a Locale.
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeKey{}, locale)
+}
+
+// Returns the locale set by WithLocale, or an empty string.
+func LocaleFromContext(ctx context.Context) string {
+	var locale, _ = ctx.Value(localeKey{}).(string)
+	return locale
+}
+
+// Guesses the locale of a text, returning an empty string if unsure.
+type LanguageDetector interface {
+	Detect(text string) (locale string, err error)
+}
+
+type LanguageDetectorFunc func(text string) (locale string, err error)
+
+func (f LanguageDetectorFunc) Detect(text string) (string, error) {
+	return f(text)
+}
+
+// Routes requests to one of several wit.ai apps, each with its own Client
+// and server access token, by locale.  The app for a request is picked by:
+//
+//  1. The locale of the context, see WithLocale.
+//  2. The locale returned by the Detector for the text of the request.
+//  3. The first locale of Fallback with an app.
+//
+// A locale such as "es-MX" without an app of its own uses the app for its
+// language, "es".  Converse steps without text use the app of the previous
+// step of their session.
+type MultiAppClient struct {
+	Detector LanguageDetector
+	Fallback []string
+	// The number of sessions whose locale is remembered for converse steps.
+	// The least recently used session is forgotten first.
+	MaxSessions int
+
+	mu       sync.Mutex
+	apps     map[string]*Client
+	order    *list.List
+	sessions map[SessionID]*list.Element
+}
+
+type multiAppSession struct {
+	id     SessionID
+	locale string
+}
+
+// The default MaxSessions of a MultiAppClient.
+const MULTIAPP_MAX_SESSIONS = 10000
+
+// Creates a client with no apps.  The fallback locales are tried in order
+// when a request has no locale with an app.
+func NewMultiAppClient(fallback ...string) *MultiAppClient {
+	return &MultiAppClient{
+		Fallback:    fallback,
+		MaxSessions: MULTIAPP_MAX_SESSIONS,
+		apps:        map[string]*Client{},
+		order:       list.New(),
+		sessions:    map[SessionID]*list.Element{},
+	}
+}
+
+// Adds the app serving locale.
+func (m *MultiAppClient) Add(locale string, client *Client) *MultiAppClient {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apps[strings.ToLower(locale)] = client
+	return m
+}
+
+// Returns the app for locale or its language.
+func (m *MultiAppClient) app(locale string) (client *Client, found bool) {
+	locale = strings.ToLower(locale)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if client, found = m.apps[locale]; !found {
+		if i := strings.IndexAny(locale, "-_"); i > 0 {
+			client, found = m.apps[locale[:i]]
+		}
+	}
+	return
+}
+
+// Returns the app a request for text should be sent to, and its locale.
+func (m *MultiAppClient) Client(ctx context.Context, text string) (client *Client, locale string, err error) {
+	var found bool
+	if locale = LocaleFromContext(ctx); locale != "" {
+		if client, found = m.app(locale); found {
+			return
+		}
+	}
+	if m.Detector != nil && strings.TrimSpace(text) != "" {
+		if locale, err = m.Detector.Detect(text); err != nil {
+			return
+		}
+		if client, found = m.app(locale); found {
+			return
+		}
+	}
+	for _, locale = range m.Fallback {
+		if client, found = m.app(locale); found {
+			return
+		}
+	}
+	err = fmt.Errorf("No app for locale %q and no fallback app", LocaleFromContext(ctx))
+	return
+}
+
+// Returns the locale of the previous converse step of a session.
+func (m *MultiAppClient) sessionLocale(sessionID SessionID) (locale string, found bool) {
+	var element *list.Element
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, found = m.sessions[sessionID]; found {
+		m.order.MoveToFront(element)
+		locale = element.Value.(*multiAppSession).locale
+	}
+	return
+}
+
+// Remembers the locale of a session, forgetting the least recently used
+// sessions beyond MaxSessions.
+func (m *MultiAppClient) setSessionLocale(sessionID SessionID, locale string) {
+	var (
+		element *list.Element
+		found   bool
+	)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, found = m.sessions[sessionID]; found {
+		element.Value.(*multiAppSession).locale = locale
+		m.order.MoveToFront(element)
+		return
+	}
+	m.sessions[sessionID] = m.order.PushFront(&multiAppSession{id: sessionID, locale: locale})
+	for m.MaxSessions > 0 && m.order.Len() > m.MaxSessions {
+		element = m.order.Back()
+		m.order.Remove(element)
+		delete(m.sessions, element.Value.(*multiAppSession).id)
+	}
+}
+
+func (m *MultiAppClient) Message(msg string) (response *Response, err error) {
+	return m.MessageContext(context.Background(), msg)
+}
+
+func (m *MultiAppClient) MessageContext(ctx context.Context, msg string) (response *Response, err error) {
+	return m.MessageWithOptions(ctx, msg, nil)
+}
+
+func (m *MultiAppClient) MessageWithOptions(ctx context.Context, msg string, options *MessageOptions) (response *Response, err error) {
+	var client *Client
+	if client, _, err = m.Client(ctx, msg); err != nil {
+		return
+	}
+	return client.MessageWithOptions(ctx, msg, options)
+}
+
+func (m *MultiAppClient) Converse(sessionID SessionID, q string, witContext interface{}) (response *Response, err error) {
+	return m.ConverseContext(context.Background(), sessionID, q, witContext)
+}
+
+func (m *MultiAppClient) ConverseContext(ctx context.Context, sessionID SessionID, q string, witContext interface{}) (response *Response, err error) {
+	var (
+		client *Client
+		locale string
+		found  bool
+	)
+	if q == "" && LocaleFromContext(ctx) == "" {
+		if locale, found = m.sessionLocale(sessionID); found {
+			ctx = WithLocale(ctx, locale)
+		}
+	}
+	if client, locale, err = m.Client(ctx, q); err != nil {
+		return
+	}
+	m.setSessionLocale(sessionID, locale)
+	return client.ConverseContext(ctx, sessionID, q, witContext)
+}
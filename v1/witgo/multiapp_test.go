@@ -0,0 +1,130 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Starts a server for the app of a locale which records the locales of the
+// /converse requests it receives.
+func newLocaleServer(t *testing.T, locale string, mu *sync.Mutex, got *[]string) *Client {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*got = append(*got, locale)
+		mu.Unlock()
+		fmt.Fprint(w, `{"type": "stop"}`)
+	}))
+	t.Cleanup(server.Close)
+	return NewClient("token", WithBaseURL(server.URL))
+}
+
+func TestMultiAppClientRouting(t *testing.T) {
+	var (
+		en, es, frCA = &Client{}, &Client{}, &Client{}
+		m            = NewMultiAppClient("de", "en").Add("en", en).Add("es", es).Add("fr-CA", frCA)
+		tests        = []struct {
+			name   string
+			locale string
+			text   string
+			want   *Client
+			err    bool
+		}{
+			{name: "context locale", locale: "es", text: "hello", want: es},
+			{name: "context locale before detector", locale: "en", text: "hola", want: en},
+			{name: "language of locale", locale: "es-MX", text: "hello", want: es},
+			{name: "case and underscore", locale: "ES_mx", want: es},
+			{name: "exact locale", locale: "fr-CA", want: frCA},
+			{name: "detector", locale: "it", text: "hola", want: es},
+			{name: "detector without context", text: "hola", want: es},
+			{name: "fallback", text: "hello", want: en},
+			{name: "no text skips detector", want: en},
+			{name: "detector error", text: "fail", err: true},
+		}
+	)
+	m.Detector = LanguageDetectorFunc(func(text string) (string, error) {
+		switch {
+		case text == "fail":
+			return "", errors.New("failed")
+		case strings.Contains(text, "hola"):
+			return "es", nil
+		case text == "":
+			t.Errorf("Expected the detector not to be called without text")
+		}
+		return "", nil
+	})
+	for _, test := range tests {
+		var (
+			ctx    = context.Background()
+			client *Client
+			err    error
+		)
+		if test.locale != "" {
+			ctx = WithLocale(ctx, test.locale)
+		}
+		client, _, err = m.Client(ctx, test.text)
+		if (err != nil) != test.err || client != test.want {
+			t.Errorf("%v: got client %p and error %v, want %p", test.name, client, err, test.want)
+		}
+	}
+	if _, _, err := NewMultiAppClient("de").Add("en", en).Client(context.Background(), "hi"); err == nil {
+		t.Errorf("Expected an error without a fallback app")
+	}
+}
+
+func TestMultiAppClientForgetsLeastRecentSession(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []string
+		m   = NewMultiAppClient("fr")
+		en  = WithLocale(context.Background(), "en")
+		es  = WithLocale(context.Background(), "es")
+		bg  = context.Background()
+		err error
+	)
+	for _, locale := range []string{"en", "es", "fr"} {
+		m.Add(locale, newLocaleServer(t, locale, &mu, &got))
+	}
+	m.MaxSessions = 2
+	for _, step := range []struct {
+		ctx       context.Context
+		sessionID SessionID
+		q         string
+	}{
+		{es, "s1", "hola"},
+		{en, "s2", "hello"},
+		{bg, "s1", ""}, // Uses s1 again, so s2 is the least recently used.
+		{en, "s3", "hello"},
+		{bg, "s1", ""},
+		{bg, "s2", ""}, // Forgotten, so the fallback app is used.
+	} {
+		if _, err = m.ConverseContext(step.ctx, step.sessionID, step.q, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := "es en es en es fr"; strings.Join(got, " ") != want {
+		t.Errorf("got apps %v, want %v", got, want)
+	}
+	if len(m.sessions) != 2 || m.order.Len() != 2 {
+		t.Errorf("Expected 2 sessions to be remembered, got %v", len(m.sessions))
+	}
+}
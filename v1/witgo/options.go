@@ -0,0 +1,102 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Describes the user sending a message, which changes how wit.ai resolves
+// entities such as wit/datetime and wit/location.
+type QueryContext struct {
+	// The time relative expressions such as "tomorrow" are resolved against.
+	// Defaults to the time of the request.
+	ReferenceTime time.Time
+	// An IANA time zone such as "America/Los_Angeles".
+	Timezone string
+	// A locale such as "en_US".
+	Locale string
+	// The location of the user.
+	Coords *Coords
+}
+
+func (c QueryContext) MarshalJSON() ([]byte, error) {
+	var data = struct {
+		ReferenceTime string  `json:"reference_time,omitempty"`
+		Timezone      string  `json:"timezone,omitempty"`
+		Locale        string  `json:"locale,omitempty"`
+		Coords        *Coords `json:"coords,omitempty"`
+	}{
+		Timezone: c.Timezone,
+		Locale:   c.Locale,
+		Coords:   c.Coords,
+	}
+	if !c.ReferenceTime.IsZero() {
+		data.ReferenceTime = c.ReferenceTime.Format(time.RFC3339)
+	}
+	return json.Marshal(data)
+}
+
+// A value of a dynamic entity and the synonyms which match it.
+type DynamicValue struct {
+	Keyword  string   `json:"keyword"`
+	Synonyms []string `json:"synonyms,omitempty"`
+}
+
+// Values added to the entities of the app for a single request, keyed by
+// entity name.
+type DynamicEntities map[string][]DynamicValue
+
+// Configures a request to the /message endpoint.  The zero value sends only
+// the text of the message.
+type MessageOptions struct {
+	Context *QueryContext
+	// The number of intents to return, see MessageResponse.Intents.
+	N int
+	// The version of the app to use.  Defaults to the current version.
+	Tag string
+	// Values added to the app's entities for this request only.
+	Entities DynamicEntities
+}
+
+// Returns the query parameters of a request for msg.
+func (o *MessageOptions) fields(msg string) (fields map[string]string, err error) {
+	var b []byte
+	fields = map[string]string{"q": msg}
+	if o == nil {
+		return
+	}
+	if o.Context != nil {
+		if b, err = json.Marshal(o.Context); err != nil {
+			return
+		}
+		fields["context"] = string(b)
+	}
+	if o.N > 0 {
+		fields["n"] = strconv.Itoa(o.N)
+	}
+	if o.Tag != "" {
+		fields["tag"] = o.Tag
+	}
+	if len(o.Entities) > 0 {
+		if b, err = json.Marshal(map[string]DynamicEntities{"entities": o.Entities}); err != nil {
+			return
+		}
+		fields["dynamic_entities"] = string(b)
+	}
+	return
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMessageOptionsFields(t *testing.T) {
+	var tests = []struct {
+		name    string
+		options *MessageOptions
+		want    map[string]string
+	}{
+		{"nil", nil, map[string]string{"q": "hi"}},
+		{"zero", &MessageOptions{}, map[string]string{"q": "hi"}},
+		{
+			"context",
+			&MessageOptions{Context: &QueryContext{
+				ReferenceTime: time.Date(2016, 5, 1, 9, 0, 0, 0, time.UTC),
+				Timezone:      "Europe/Paris",
+				Coords:        &Coords{Lat: 48.85, Long: 2.35},
+			}},
+			map[string]string{
+				"q":       "hi",
+				"context": `{"reference_time":"2016-05-01T09:00:00Z","timezone":"Europe/Paris","coords":{"lat":48.85,"long":2.35}}`,
+			},
+		},
+		{"empty context", &MessageOptions{Context: &QueryContext{}}, map[string]string{"q": "hi", "context": "{}"}},
+		{"n and tag", &MessageOptions{N: 3, Tag: "prod"}, map[string]string{"q": "hi", "n": "3", "tag": "prod"}},
+		{
+			"entities",
+			&MessageOptions{Entities: DynamicEntities{"contact": {{Keyword: "Jane", Synonyms: []string{"J"}}}}},
+			map[string]string{
+				"q":                "hi",
+				"dynamic_entities": `{"entities":{"contact":[{"keyword":"Jane","synonyms":["J"]}]}}`,
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := test.options.fields("hi")
+		if err != nil {
+			t.Errorf("%v: got error %v", test.name, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for key, want := range test.want {
+			if got[key] != want {
+				t.Errorf("%v: got %v=%v, want %v", test.name, key, got[key], want)
+			}
+		}
+	}
+}
+
+func TestMessageWithContextBypassesCache(t *testing.T) {
+	var (
+		calls   atomic.Int64
+		server  = newEchoServer(&calls)
+		client  = NewClient("token", WithBaseURL(server.URL), WithCache(NewMemoryCache(10, 0)))
+		options = &MessageOptions{Context: &QueryContext{Timezone: "Europe/Paris"}}
+	)
+	defer server.Close()
+	for i := 0; i < 2; i++ {
+		response, err := client.MessageWithOptions(context.Background(), "tomorrow", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response, err = client.MessageWithOptions(context.Background(), "hello", &MessageOptions{N: 2}); err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("Expected 3 requests, got %v", calls.Load())
+	}
+	if stats := client.CacheStats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("Expected only requests without a context to use the cache, got %+v", stats)
+	}
+}
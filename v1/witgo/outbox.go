@@ -0,0 +1,369 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A message waiting in an Outbox.
+type OutboxMessage struct {
+	ID        uint64    `json:"id"`
+	SessionID SessionID `json:"session_id"`
+	Text      string    `json:"text"`
+	Attempts  int       `json:"attempts"`
+	Created   time.Time `json:"created"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Wraps an error returned by a Responder so that an Outbox hands the message
+// to its dead letter callback instead of retrying.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// Reports whether err was wrapped with Permanent.
+func IsPermanent(err error) bool {
+	var perm permanentError
+	return errors.As(err, &perm)
+}
+
+// Implemented by errors which know how long to wait before retrying, such as
+// rate limit errors.
+type retryAfter interface {
+	RetryAfter() time.Duration
+}
+
+// Returns the wait after the given number of failed attempts, starting at
+// one second after the first and doubling after each, capped at five
+// minutes.
+func DefaultBackoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt > 9 {
+		return 5 * time.Minute
+	}
+	if d := time.Second << uint(attempt-1); d < 5*time.Minute {
+		return d
+	}
+	return 5 * time.Minute
+}
+
+// Queues messages said by the bot and delivers them through another
+// Responder, retrying failed deliveries with backoff.  Messages for a session
+// are delivered one at a time, in the order they were queued.
+//
+// If created with a path, the queue is written to disk after every change so
+// pending messages survive a restart.
+type Outbox struct {
+	Responder   Responder
+	MaxAttempts int
+	// Returns the wait after the given number of failed attempts, starting
+	// at 1.
+	Backoff    func(attempt int) time.Duration
+	DeadLetter func(msg OutboxMessage, err error)
+	// Receives errors writing the queue to disk.  Nil disables logging.
+	Logger *slog.Logger
+
+	path    string
+	mu      sync.Mutex
+	idle    *sync.Cond
+	nextID  uint64
+	pending map[SessionID][]*OutboxMessage
+	running map[SessionID]bool
+	started bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Creates an Outbox delivering through responder, loading any messages left
+// pending at path.  An empty path keeps the queue in memory only.
+// Call Start to begin delivery.
+func NewOutbox(path string, responder Responder) (o *Outbox, err error) {
+	o = &Outbox{
+		Responder:   responder,
+		MaxAttempts: 10,
+		Backoff:     DefaultBackoff,
+		path:        path,
+		pending:     map[SessionID][]*OutboxMessage{},
+		running:     map[SessionID]bool{},
+		stop:        make(chan struct{}),
+	}
+	o.idle = sync.NewCond(&o.mu)
+	if err = o.load(); err != nil {
+		o = nil
+	}
+	return
+}
+
+func (o *Outbox) load() (err error) {
+	var (
+		b        []byte
+		messages []*OutboxMessage
+		msg      *OutboxMessage
+	)
+	if o.path == "" {
+		return
+	}
+	if b, err = ioutil.ReadFile(o.path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(b, &messages); err != nil {
+		return
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	for _, msg = range messages {
+		o.pending[msg.SessionID] = append(o.pending[msg.SessionID], msg)
+		if msg.ID >= o.nextID {
+			o.nextID = msg.ID + 1
+		}
+	}
+	return
+}
+
+// Must be called with the lock held.
+func (o *Outbox) save() (err error) {
+	var (
+		messages = []*OutboxMessage{}
+		queue    []*OutboxMessage
+		b        []byte
+		tmp      = o.path + ".tmp"
+	)
+	if o.path == "" {
+		return
+	}
+	for _, queue = range o.pending {
+		messages = append(messages, queue...)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	if b, err = json.Marshal(messages); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return
+	}
+	err = os.Rename(tmp, o.path)
+	return
+}
+
+// Begins delivering queued messages, including any loaded from disk.
+func (o *Outbox) Start() {
+	var id SessionID
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.started {
+		return
+	}
+	o.started = true
+	for id = range o.pending {
+		o.spawn(id)
+	}
+}
+
+// Must be called with the lock held.
+func (o *Outbox) spawn(id SessionID) {
+	if !o.started || o.running[id] {
+		return
+	}
+	if o.stopped() {
+		return
+	}
+	o.running[id] = true
+	o.wg.Add(1)
+	go o.run(id)
+}
+
+func (o *Outbox) stopped() bool {
+	select {
+	case <-o.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Queues a message for delivery.  Returns once the message has been persisted.
+// If it cannot be persisted, the message is dropped and the error returned, so
+// the caller decides whether to send it again.
+func (o *Outbox) Respond(sessionID SessionID, msg string) (err error) {
+	var queue []*OutboxMessage
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	queue = o.pending[sessionID]
+	o.pending[sessionID] = append(queue, &OutboxMessage{
+		ID:        o.nextID,
+		SessionID: sessionID,
+		Text:      msg,
+		Created:   time.Now(),
+	})
+	o.nextID++
+	if err = o.save(); err != nil {
+		if o.pending[sessionID] = queue; len(queue) == 0 {
+			delete(o.pending, sessionID)
+		}
+		return
+	}
+	o.spawn(sessionID)
+	return
+}
+
+// Returns the number of messages which have not been delivered yet.
+func (o *Outbox) Pending() (count int) {
+	var queue []*OutboxMessage
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, queue = range o.pending {
+		count += len(queue)
+	}
+	return
+}
+
+// Removes the head of a session's queue.  Must be called with the lock held.
+func (o *Outbox) pop(id SessionID) error {
+	if o.pending[id] = o.pending[id][1:]; len(o.pending[id]) == 0 {
+		delete(o.pending, id)
+		if len(o.pending) == 0 {
+			o.idle.Broadcast()
+		}
+	}
+	return o.save()
+}
+
+// Logs errors writing the queue from a delivery worker, which has no caller
+// to return them to.  The queue is written again on the next change.
+func (o *Outbox) logSaveError(err error) {
+	if err != nil && o.Logger != nil {
+		o.Logger.LogAttrs(context.Background(), slog.LevelError, "saving outbox failed",
+			slog.String("path", o.path),
+			slog.Any("error", err),
+		)
+	}
+}
+
+func (o *Outbox) run(id SessionID) {
+	var (
+		msg   *OutboxMessage
+		err   error
+		wait  time.Duration
+		retry retryAfter
+		perm  permanentError
+	)
+	defer o.wg.Done()
+	for true {
+		o.mu.Lock()
+		if len(o.pending[id]) == 0 || o.stopped() {
+			delete(o.running, id)
+			o.mu.Unlock()
+			return
+		}
+		msg = o.pending[id][0]
+		o.mu.Unlock()
+		if err = o.Responder.Respond(msg.SessionID, msg.Text); err == nil {
+			o.mu.Lock()
+			o.logSaveError(o.pop(id))
+			o.mu.Unlock()
+			continue
+		}
+		o.mu.Lock()
+		msg.Attempts++
+		msg.LastError = err.Error()
+		if errors.As(err, &perm) || (o.MaxAttempts > 0 && msg.Attempts >= o.MaxAttempts) {
+			o.logSaveError(o.pop(id))
+			o.mu.Unlock()
+			if o.DeadLetter != nil {
+				o.DeadLetter(*msg, err)
+			}
+			continue
+		}
+		o.logSaveError(o.save())
+		o.mu.Unlock()
+		wait = o.Backoff(msg.Attempts)
+		if errors.As(err, &retry) && retry.RetryAfter() > wait {
+			wait = retry.RetryAfter()
+		}
+		select {
+		case <-time.After(wait):
+		case <-o.stop:
+			o.mu.Lock()
+			delete(o.running, id)
+			o.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Blocks until every queued message has been delivered or dead lettered, or
+// ctx is done.  Messages failing with retryable errors stay queued until
+// MaxAttempts is reached, so pass a ctx with a deadline to bound the wait.
+// Returns ctx's error if messages are still pending.
+func (o *Outbox) Wait(ctx context.Context) (err error) {
+	var stop = context.AfterFunc(ctx, func() {
+		o.mu.Lock()
+		o.idle.Broadcast()
+		o.mu.Unlock()
+	})
+	defer stop()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for len(o.pending) > 0 {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		o.idle.Wait()
+	}
+	return
+}
+
+// Stops delivery and waits for in-flight attempts to finish.  Messages which
+// have not been delivered remain on disk for the next Start.
+func (o *Outbox) Close() (err error) {
+	o.mu.Lock()
+	if !o.stopped() {
+		close(o.stop)
+	}
+	o.mu.Unlock()
+	o.wg.Wait()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err = o.save()
+	return
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDefaultBackoff(t *testing.T) {
+	var tests = []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{9, 256 * time.Second},
+		{10, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := DefaultBackoff(test.attempt); got != test.want {
+			t.Errorf("DefaultBackoff(%v) = %v, want %v", test.attempt, got, test.want)
+		}
+	}
+}
+
+type failingResponder struct {
+	err error
+}
+
+func (r failingResponder) Respond(sessionID SessionID, msg string) error {
+	return r.err
+}
+
+func TestOutboxWaitHonorsContext(t *testing.T) {
+	var (
+		outbox, err = NewOutbox("", failingResponder{errors.New("Unavailable")})
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	)
+	defer cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.Backoff = func(int) time.Duration { return time.Millisecond }
+	outbox.MaxAttempts = 0
+	outbox.Start()
+	defer outbox.Close()
+	if err = outbox.Respond("s", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if outbox.Pending() != 1 {
+		t.Fatalf("Expected the message to stay pending, got %v", outbox.Pending())
+	}
+}
+
+func TestOutboxDeadLettersPermanentErrors(t *testing.T) {
+	var (
+		outbox, err = NewOutbox("", failingResponder{Permanent(errors.New("Bad user"))})
+		dead        = make(chan OutboxMessage, 1)
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.DeadLetter = func(msg OutboxMessage, err error) { dead <- msg }
+	outbox.Start()
+	defer outbox.Close()
+	outbox.Respond("s", "hi")
+	if err = outbox.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-dead; msg.Text != "hi" || msg.Attempts != 1 {
+		t.Fatalf("Unexpected dead letter %+v", msg)
+	}
+}
+
+// Records delivered messages.
+type outboxRecorder struct {
+	mu        sync.Mutex
+	delivered []string
+}
+
+func (r *outboxRecorder) Respond(sessionID SessionID, msg string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delivered = append(r.delivered, string(sessionID)+": "+msg)
+	return nil
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	var (
+		path      = filepath.Join(t.TempDir(), "outbox.json")
+		recorder  = &outboxRecorder{}
+		outbox    *Outbox
+		err       error
+		want      = []string{"a: one", "b: two", "a: three"}
+		delivered []string
+	)
+	if outbox, err = NewOutbox(path, recorder); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []struct {
+		session SessionID
+		text    string
+	}{{"a", "one"}, {"b", "two"}, {"a", "three"}} {
+		if err = outbox.Respond(msg.session, msg.text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outbox.Close()
+	if outbox, err = NewOutbox(path, recorder); err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Pending() != 3 {
+		t.Fatalf("Expected 3 messages reloaded, got %v", outbox.Pending())
+	}
+	outbox.Start()
+	defer outbox.Close()
+	if err = outbox.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.Respond("a", "four"); err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "a: four")
+	recorder.mu.Lock()
+	delivered = append(delivered, recorder.delivered...)
+	recorder.mu.Unlock()
+	for _, session := range []string{"a: ", "b: "} {
+		var got, expected []string
+		for _, msg := range delivered {
+			if strings.HasPrefix(msg, session) {
+				got = append(got, msg)
+			}
+		}
+		for _, msg := range want {
+			if strings.HasPrefix(msg, session) {
+				expected = append(expected, msg)
+			}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%vgot %q, want %q", session, got, expected)
+		}
+	}
+}
+
+func TestOutboxDropsUnsavedMessages(t *testing.T) {
+	var (
+		path     = filepath.Join(t.TempDir(), "missing", "outbox.json")
+		recorder = &outboxRecorder{}
+		outbox   *Outbox
+		err      error
+	)
+	if outbox, err = NewOutbox(path, recorder); err != nil {
+		t.Fatal(err)
+	}
+	outbox.Start()
+	defer outbox.Close()
+	if err = outbox.Respond("s", "hi"); err == nil {
+		t.Fatal("Expected saving to a missing directory to fail")
+	}
+	if outbox.Pending() != 0 {
+		t.Fatalf("Expected the unsaved message to be dropped, got %v pending", outbox.Pending())
+	}
+	if err = outbox.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.delivered) != 0 {
+		t.Fatalf("Expected nothing delivered, got %q", recorder.delivered)
+	}
+}
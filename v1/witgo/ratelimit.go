@@ -0,0 +1,95 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limits the rate of requests made by a Client.  Wait blocks until a request
+// may be made or ctx is done.
+type RateLimiter interface {
+	Wait(ctx context.Context) (err error)
+}
+
+// A RateLimiter allowing Rate requests per second on average and bursts of
+// up to Burst requests.  A Rate of zero or less does not limit requests and
+// a Burst below one is treated as one.
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Creates a full bucket.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		Rate:   rate,
+		Burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Takes a token, waiting for one to be added if the bucket is empty.
+// Tokens are reserved in order, so waiting callers are served first come,
+// first served.
+func (b *TokenBucket) Wait(ctx context.Context) (err error) {
+	var (
+		now   = time.Now()
+		burst = float64(b.Burst)
+		wait  time.Duration
+		timer *time.Timer
+	)
+	if b.Rate <= 0 {
+		return ctx.Err()
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	b.mu.Lock()
+	b.tokens += now.Sub(b.last).Seconds() * b.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.Rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait <= 0 {
+		return
+	}
+	timer = time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		err = ctx.Err()
+	}
+	return
+}
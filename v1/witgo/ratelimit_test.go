@@ -0,0 +1,71 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var tests = []struct {
+		name   string
+		bucket *TokenBucket
+		calls  int
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"burst", NewTokenBucket(1, 3), 3, 0, 50 * time.Millisecond},
+		{"refill", NewTokenBucket(20, 1), 3, 90 * time.Millisecond, time.Second},
+		{"zero rate is unlimited", NewTokenBucket(0, 1), 100, 0, 50 * time.Millisecond},
+		{"negative rate is unlimited", &TokenBucket{Rate: -1}, 100, 0, 50 * time.Millisecond},
+		{"zero burst is one", &TokenBucket{Rate: 20}, 3, 90 * time.Millisecond, time.Second},
+		{"clamped burst", NewTokenBucket(20, 0), 3, 90 * time.Millisecond, time.Second},
+	}
+	for _, test := range tests {
+		var (
+			start = time.Now()
+			err   error
+		)
+		for i := 0; i < test.calls; i++ {
+			if err = test.bucket.Wait(context.Background()); err != nil {
+				t.Fatalf("%v: got error %v", test.name, err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < test.min || elapsed > test.max {
+			t.Errorf("%v: got %v, want between %v and %v", test.name, elapsed, test.min, test.max)
+		}
+	}
+}
+
+func TestTokenBucketCanceledWaitReturnsToken(t *testing.T) {
+	var (
+		bucket      = NewTokenBucket(10, 1)
+		ctx, cancel = context.WithCancel(context.Background())
+		err         error
+	)
+	if err = bucket.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err = bucket.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if bucket.tokens < -0.01 {
+		t.Fatalf("Expected the canceled wait to return its token, got %v tokens", bucket.tokens)
+	}
+}
@@ -14,10 +14,18 @@
 
 package witgo
 
+import (
+	"context"
+	"time"
+)
+
 type SessionID string
 
 type Session struct {
-	id      SessionID
+	id  SessionID
+	ctx context.Context
+	// The locale of the user, such as "en" or "es-MX".  Empty if unknown.
+	Locale string
 	Context
 }
 
@@ -31,3 +39,57 @@ func NewSession(id SessionID) *Session {
 func (s *Session) ID() SessionID {
 	return s.id
 }
+
+// Returns the context of the Handler callback being run, which carries its
+// tracing span.  Outside of a callback returns context.Background().
+func (s *Session) Ctx() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// Holds the sessions of Witgo.Process, forgetting sessions which have not
+// completed a turn for longer than ttl.  A zero ttl keeps sessions forever.
+type sessionStore struct {
+	ttl      time.Duration
+	sessions map[SessionID]*Session
+	seen     map[SessionID]time.Time
+	pruned   time.Time
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{
+		ttl:      ttl,
+		sessions: map[SessionID]*Session{},
+		seen:     map[SessionID]time.Time{},
+	}
+}
+
+func (s *sessionStore) get(id SessionID) (session *Session, found bool) {
+	session, found = s.sessions[id]
+	return
+}
+
+func (s *sessionStore) put(session *Session, now time.Time) {
+	s.sessions[session.ID()] = session
+	s.seen[session.ID()] = now
+}
+
+// Forgets expired sessions, scanning at most once a second.
+func (s *sessionStore) prune(now time.Time) {
+	if s.ttl <= 0 || now.Sub(s.pruned) < time.Second {
+		return
+	}
+	s.pruned = now
+	for id, seen := range s.seen {
+		if now.Sub(seen) > s.ttl {
+			delete(s.sessions, id)
+			delete(s.seen, id)
+		}
+	}
+}
+
+func (s *sessionStore) len() int {
+	return len(s.sessions)
+}
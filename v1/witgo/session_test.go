@@ -0,0 +1,45 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionStoreExpiresIdleSessions(t *testing.T) {
+	var (
+		store = newSessionStore(time.Minute)
+		start = time.Now()
+	)
+	store.put(NewSession("old"), start)
+	store.put(NewSession("new"), start.Add(50*time.Second))
+	store.prune(start.Add(90 * time.Second))
+	if _, found := store.get("old"); found {
+		t.Error("Expected the idle session to expire")
+	}
+	if _, found := store.get("new"); !found || store.len() != 1 {
+		t.Errorf("Expected only the recent session, got %v", store.len())
+	}
+}
+
+func TestSessionStoreWithoutTTL(t *testing.T) {
+	var store = newSessionStore(0)
+	store.put(NewSession("s"), time.Now().Add(-24*time.Hour))
+	store.prune(time.Now())
+	if store.len() != 1 {
+		t.Fatal("Expected sessions to be kept without a TTL")
+	}
+}
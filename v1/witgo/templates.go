@@ -0,0 +1,231 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Renders a message before it is said.
+type Renderer interface {
+	Render(session *Session, msg string) (out string, err error)
+}
+
+// How MessageTemplates picks between the variants of a template.
+type VariantSelection int
+
+const (
+	SELECT_RANDOM VariantSelection = iota
+	SELECT_ROUND_ROBIN
+)
+
+// The variants of a named template.
+type messageTemplate struct {
+	variants []*template.Template
+	next     int
+}
+
+// A Renderer which replaces messages with named templates.  Templates are
+// grouped by locale and may have several variants, one of which is picked
+// each time the template is rendered.  Messages which do not name a template
+// are said unchanged.
+//
+// Templates are executed with text/template against Session.Context, so
+// "It's {{.forecast}} in {{.loc}}." interpolates context keys.  The plural
+// function picks a word by count:
+//
+//	You have {{.count}} {{plural .count "message" "messages"}}.
+//
+// plural follows English rules, picking the singular only for a count of
+// exactly one.  Locales with other plural rules should spell out the forms
+// they need with text/template conditions instead.
+type MessageTemplates struct {
+	// Used when a session has no locale or no template for it.
+	DefaultLocale string
+	Selection     VariantSelection
+
+	mu      sync.Mutex
+	locales map[string]map[string]*messageTemplate
+}
+
+func NewMessageTemplates(defaultLocale string) *MessageTemplates {
+	return &MessageTemplates{
+		DefaultLocale: defaultLocale,
+		Selection:     SELECT_RANDOM,
+		locales:       map[string]map[string]*messageTemplate{},
+	}
+}
+
+var templateFuncs = template.FuncMap{
+	"plural": plural,
+}
+
+// Returns singular if n is one, or else plural.  English rules only.
+func plural(n interface{}, singular string, plural string) (string, error) {
+	var (
+		count float64
+		err   error
+	)
+	switch v := n.(type) {
+	case int:
+		count = float64(v)
+	case int64:
+		count = float64(v)
+	case float64:
+		count = v
+	case string:
+		if count, err = strconv.ParseFloat(v, 64); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("Cannot pluralize by %T", n)
+	}
+	if count == 1 {
+		return singular, nil
+	}
+	return plural, nil
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// Adds a template with one or more variants, replacing any template with
+// the same name and locale.
+func (t *MessageTemplates) Add(locale string, name string, variants ...string) (err error) {
+	var (
+		tmpl *messageTemplate = &messageTemplate{}
+		v    *template.Template
+	)
+	if len(variants) == 0 {
+		return fmt.Errorf("Template %v has no variants", name)
+	}
+	for i, text := range variants {
+		if v, err = parseTemplate(fmt.Sprintf("%v/%v.%v", locale, name, i), text); err != nil {
+			return
+		}
+		tmpl.variants = append(tmpl.variants, v)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.locales[locale] == nil {
+		t.locales[locale] = map[string]*messageTemplate{}
+	}
+	t.locales[locale][name] = tmpl
+	return
+}
+
+// Adds the templates of a locale from a JSON file mapping template names to
+// a string or a list of variants:
+//
+//	{"greeting": ["Hi!", "Hello!"], "forecast": "It's {{.forecast}}."}
+func (t *MessageTemplates) LoadFile(locale string, path string) (err error) {
+	var (
+		data     []byte
+		entries  map[string]json.RawMessage
+		variants []string
+		text     string
+	)
+	if data, err = os.ReadFile(path); err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("Could not parse %v: %v", path, err)
+	}
+	for name, raw := range entries {
+		variants = nil
+		if err = json.Unmarshal(raw, &text); err == nil {
+			variants = []string{text}
+		} else if err = json.Unmarshal(raw, &variants); err != nil {
+			return fmt.Errorf("Template %v in %v is not a string or list of strings", name, path)
+		}
+		if err = t.Add(locale, name, variants...); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Loads every file named <locale>.json in dir, see LoadFile.
+func (t *MessageTemplates) LoadDir(dir string) (err error) {
+	var paths []string
+	if paths, err = filepath.Glob(filepath.Join(dir, "*.json")); err != nil {
+		return
+	}
+	for _, path := range paths {
+		if err = t.LoadFile(strings.TrimSuffix(filepath.Base(path), ".json"), path); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Returns the template named name for locale, trying the language of the
+// locale ("es" for "es-MX") and then DefaultLocale.
+func (t *MessageTemplates) lookup(locale string, name string) (out *template.Template) {
+	var (
+		candidates = []string{locale}
+		tmpl       *messageTemplate
+		found      bool
+	)
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	candidates = append(candidates, t.DefaultLocale)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, candidate := range candidates {
+		if tmpl, found = t.locales[candidate][name]; found {
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	switch t.Selection {
+	case SELECT_ROUND_ROBIN:
+		out = tmpl.variants[tmpl.next%len(tmpl.variants)]
+		tmpl.next++
+	default:
+		out = tmpl.variants[rand.Intn(len(tmpl.variants))]
+	}
+	return
+}
+
+// Renders the template named msg for the locale of the session, or msg
+// itself if there is no such template.
+func (t *MessageTemplates) Render(session *Session, msg string) (out string, err error) {
+	var (
+		tmpl *template.Template
+		buf  bytes.Buffer
+	)
+	if tmpl = t.lookup(session.Locale, msg); tmpl == nil {
+		return msg, nil
+	}
+	if err = tmpl.Execute(&buf, session.Context); err != nil {
+		return
+	}
+	out = buf.String()
+	return
+}
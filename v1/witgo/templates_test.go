@@ -0,0 +1,86 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"testing"
+)
+
+func TestMessageTemplatesRender(t *testing.T) {
+	var (
+		templates = NewMessageTemplates("en")
+		err       error
+	)
+	for _, add := range [][]string{
+		{"en", "greeting", "Hello {{.name}}!"},
+		{"es", "greeting", "¡Hola {{.name}}!"},
+		{"en", "inbox", `{{.count}} {{plural .count "message" "messages"}}`},
+	} {
+		if err = templates.Add(add[0], add[1], add[2:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		locale string
+		msg    string
+		ctx    Context
+		want   string
+	}{
+		{"", "greeting", Context{"name": "Ann"}, "Hello Ann!"},
+		{"es", "greeting", Context{"name": "Ana"}, "¡Hola Ana!"},
+		{"es-MX", "greeting", Context{"name": "Ana"}, "¡Hola Ana!"},
+		{"fr", "greeting", Context{"name": "Anne"}, "Hello Anne!"},
+		{"en", "inbox", Context{"count": 1}, "1 message"},
+		{"en", "inbox", Context{"count": "3"}, "3 messages"},
+		{"en", "Use {{.name}} as is", Context{"name": "x"}, "Use {{.name}} as is"},
+		{"en", "Plain text", nil, "Plain text"},
+	}
+	for _, test := range tests {
+		var (
+			session = NewSession("s")
+			got     string
+		)
+		session.Locale = test.locale
+		session.Context = test.ctx
+		if got, err = templates.Render(session, test.msg); err != nil {
+			t.Errorf("%v/%v: got error %v", test.locale, test.msg, err)
+		} else if got != test.want {
+			t.Errorf("%v/%v: got %q, want %q", test.locale, test.msg, got, test.want)
+		}
+	}
+}
+
+func TestMessageTemplatesRoundRobin(t *testing.T) {
+	var (
+		templates = NewMessageTemplates("en")
+		session   = NewSession("s")
+		got       []string
+		out       string
+		err       error
+	)
+	templates.Selection = SELECT_ROUND_ROBIN
+	if err = templates.Add("en", "hi", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if out, err = templates.Render(session, "hi"); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, out)
+	}
+	if got[0] != "a" || got[1] != "b" || got[2] != "a" {
+		t.Fatalf("Expected variants in turn, got %q", got)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo
+
+import (
+	"context"
+)
+
+// Starts spans for tracing.  Implement this to connect witgo to a tracing
+// library such as OpenTelemetry; the returned context must carry the new span
+// so that spans started from it become its children.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+func startSpan(tracer Tracer, ctx context.Context, name string) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, name)
+}
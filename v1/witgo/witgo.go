@@ -16,88 +16,313 @@
 package witgo
 
 import (
-	"strings"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
 )
 
 type Handler interface {
 	Action(session *Session, entities EntityMap, action string) (response *Session, err error)
-	Say(session *Session, msg string) (response *Session, err error)
 	Merge(session *Session, entities EntityMap) (response *Session, err error)
 	Error(session *Session, msg string)
 }
 
+// May be implemented by a Handler to take over delivery of messages.
+// If present, Say is called instead of the Responder.
+type Sayer interface {
+	Say(session *Session, msg string) (response *Session, err error)
+}
+
+// Delivers messages said by the bot back to the user.
+// Inputs implement this to receive the messages for their sessions.
+type Responder interface {
+	Respond(sessionID SessionID, msg string) (err error)
+}
+
 type Witgo struct {
-	client  *Client
-	handler Handler
+	// Delivers messages said by the bot.  If nil, the input is used if it
+	// implements Responder.
+	Responder Responder
+	// Receives events for every turn and converse step.  Nil disables logging.
+	Logger *slog.Logger
+	// Receives measurements of every turn and action.  Nil disables metrics.
+	Metrics Metrics
+	// Starts a span for every turn and Handler callback.  Nil disables
+	// tracing.
+	Tracer Tracer
+	// Entities with a lower confidence are removed before they are passed to
+	// Handler.Merge and Handler.Action.  Zero passes every entity.
+	MinConfidence float64
+	// Drives the dialogue of each turn.  Nil uses a ConverseEngine.
+	Engine Engine
+	// Renders every message before it is said.  Nil says messages unchanged.
+	Renderer Renderer
+	// Returns the options of /message requests made for a session, such as
+	// its time zone.  Nil sends only the text.
+	MessageOptions func(session *Session) *MessageOptions
+	// Sessions which have not completed a turn for longer are forgotten,
+	// losing their Context.  Zero keeps sessions forever.
+	SessionTTL time.Duration
+
+	client    API
+	handler   Handler
+	responder Responder
 }
 
-func NewWitgo(client *Client, handler Handler) *Witgo {
+// Creates a Witgo which sends requests through client, usually a *Client or
+// a *MultiAppClient.
+func NewWitgo(client API, handler Handler) *Witgo {
 	return &Witgo{
 		client:  client,
 		handler: handler,
 	}
 }
 
-func (w *Witgo) process(session *Session, q string) (out *Session, err error) {
+func (w *Witgo) process(ctx context.Context, session *Session, q string) (out *Session, messages []string, err error) {
 	var (
-		response *Response
-		converse *ConverseResponse
-		done     bool = false
+		engine Engine
+		steps  = &turnSteps{w: w, session: session}
+		span   Span
 	)
-	for !done {
-		if response, err = w.client.Converse(session.ID(), q, session.Context); err != nil {
+	ctx, span = startSpan(w.Tracer, ctx, "witgo.turn")
+	span.SetAttribute("witgo.session", string(session.ID()))
+	defer func() {
+		if session != nil {
+			session.ctx = nil
+		}
+		if out != nil {
+			out.ctx = nil
+		}
+		span.SetAttribute("witgo.steps", steps.count)
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+		if w.Metrics != nil {
+			w.Metrics.ObserveTurn(steps.count, err)
+		}
+	}()
+	if session.Locale != "" {
+		ctx = WithLocale(ctx, session.Locale)
+	}
+	steps.ctx = ctx
+	if engine = w.Engine; engine == nil {
+		engine = ConverseEngine{}
+	}
+	out, err = engine.Turn(steps, session, q)
+	messages = steps.messages
+	return
+}
+
+func (w *Witgo) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	if w.Logger != nil {
+		w.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+	}
+}
+
+// Runs a Handler callback in its own span.  The span's context is available
+// to the callback through Session.Ctx.
+func (w *Witgo) callback(
+	ctx context.Context,
+	name string,
+	session *Session,
+	fn func(session *Session) (*Session, error),
+) (out *Session, err error) {
+	var span Span
+	ctx, span = startSpan(w.Tracer, ctx, name)
+	defer span.End()
+	span.SetAttribute("witgo.session", string(session.ID()))
+	session.ctx = ctx
+	if out, err = fn(session); err != nil {
+		span.RecordError(err)
+	}
+	return
+}
+
+// Applies MinConfidence to entities.
+func (w *Witgo) filter(entities EntityMap) EntityMap {
+	if w.MinConfidence <= 0 || entities == nil {
+		return entities
+	}
+	return entities.Filter(w.MinConfidence)
+}
+
+func (w *Witgo) action(ctx context.Context, session *Session, entities EntityMap, action string) (out *Session, err error) {
+	var start = time.Now()
+	entities = w.filter(entities)
+	out, err = w.callback(ctx, "witgo.action "+action, session, func(session *Session) (*Session, error) {
+		return w.handler.Action(session, entities, action)
+	})
+	if w.Metrics != nil {
+		w.Metrics.ObserveAction(action, time.Since(start), err)
+	}
+	return
+}
+
+func (w *Witgo) merge(ctx context.Context, session *Session, entities EntityMap) (out *Session, err error) {
+	entities = w.filter(entities)
+	return w.callback(ctx, "witgo.merge", session, func(session *Session) (*Session, error) {
+		return w.handler.Merge(session, entities)
+	})
+}
+
+// Renders msg and delivers it.  Returns the message which was said.
+func (w *Witgo) say(ctx context.Context, session *Session, msg string) (out *Session, said string, err error) {
+	if w.Renderer != nil {
+		if msg, err = w.Renderer.Render(session, msg); err != nil {
 			return
 		}
-		if err = response.Parse(&converse); err != nil {
+	}
+	said = msg
+	out, err = w.callback(ctx, "witgo.say", session, func(session *Session) (out *Session, err error) {
+		var (
+			sayer Sayer
+			ok    bool
+		)
+		if sayer, ok = w.handler.(Sayer); ok {
+			return sayer.Say(session, msg)
+		}
+		out = session
+		if w.responder == nil {
+			err = fmt.Errorf("No Responder to deliver message to session %v", session.ID())
 			return
 		}
-		switch strings.ToLower(converse.Type) {
-		case "action":
-			if session, err = w.handler.Action(session, converse.Entities, converse.Action); err != nil {
-				return
-			}
-		case "msg":
-			if session, err = w.handler.Say(session, converse.Msg); err != nil {
-				return
-			}
-		case "merge":
-			if session, err = w.handler.Merge(session, converse.Entities); err != nil {
-				return
-			}
-		case "stop":
-			done = true
-		default:
-			done = true
+		err = w.responder.Respond(session.ID(), msg)
+		return
+	})
+	return
+}
+
+// Returns the number of records waiting in input.
+func inputBacklog(input Input, records <-chan InputRecord) int {
+	if backlogged, ok := input.(BacklogInput); ok {
+		return backlogged.Backlog()
+	}
+	return len(records)
+}
+
+// Commits a record unless its turn failed with a retryable error.  Committing a
+// duplicate only moves the position.  retry holds
+// the IDs of the records left uncommitted; the position is not moved past them.
+func (w *Witgo) commit(checkpointer *Checkpointer, record InputRecord, turnErr error, retry map[string]bool) error {
+	if turnErr != nil && IsRetryable(turnErr) {
+		if record.ID != "" {
+			retry[record.ID] = true
 		}
-		q = ""
+		w.log(slog.LevelWarn, "leaving record uncommitted",
+			slog.String("session", string(record.SessionID)),
+			slog.String("id", record.ID),
+		)
+		return nil
 	}
-	out = session
-	return
+	delete(retry, record.ID)
+	if len(retry) > 0 {
+		record.Position = ""
+	}
+	return checkpointer.Commit(record)
+}
+
+// Processes the records of input with context.Background(), see
+// ProcessContext.
+func (w *Witgo) Process(input Input) error {
+	return w.ProcessContext(context.Background(), input)
 }
 
-func (w *Witgo) Process(input Input) (err error) {
+// Reads records from the input until it closes its records channel.
+// Every record is acknowledged with a Turn, see Input for the protocol.
+// Messages are routed to the Responder unless the Handler implements Sayer.
+// If there is neither, saying a message fails the turn.
+// Errors processing a record are reported to the Handler and delivered to the
+// input in the Turn; they do not stop processing.
+// If the input implements CheckpointedInput, each record is committed once its
+// turn has finished, unless it failed with a retryable error (see
+// IsRetryable).  While such a record is outstanding, later records are marked
+// seen without moving the position, so a restarted input reads the failed
+// record again.  An input may also send it again itself with the same ID.
+//
+// Each turn runs with a context derived from ctx, so its spans are children
+// of any span in ctx and its requests are canceled with ctx.  Once ctx is
+// done, the remaining records are acknowledged with ctx's error without
+// being processed or committed, and ctx's error is returned once the input
+// closes its records channel.  Stop the input when canceling ctx.
+func (w *Witgo) ProcessContext(ctx context.Context, input Input) (err error) {
 	var (
-		record   InputRecord
-		session  *Session
-		found    bool
-		sessions = map[SessionID]*Session{}
-		requests chan<- SessionID
-		records  <-chan InputRecord
+		record       InputRecord
+		session      *Session
+		out          *Session
+		found        bool
+		turn         Turn
+		checkpointed CheckpointedInput
+		checkpointer *Checkpointer
+		sessions     = newSessionStore(w.SessionTTL)
+		turns        = make(chan Turn)
+		records      <-chan InputRecord
+		start        time.Time
+		retry        = map[string]bool{}
 	)
-	requests, records = input.Run()
+	defer close(turns)
+	if w.responder = w.Responder; w.responder == nil {
+		w.responder, _ = input.(Responder)
+	}
+	if checkpointed, found = input.(CheckpointedInput); found {
+		checkpointer = checkpointed.Checkpointer()
+	}
+	records = input.Run(turns)
 	for record = range records {
-		if session, found = sessions[record.SessionID]; !found {
+		turn = Turn{InputRecord: record}
+		if w.Metrics != nil {
+			w.Metrics.SetInputBacklog(inputBacklog(input, records))
+		}
+		if turn.Err = ctx.Err(); turn.Err != nil {
+			turns <- turn
+			continue
+		}
+		if checkpointer != nil && record.ID != "" && checkpointer.Seen(record.ID) {
+			turn.Duplicate = true
+			w.log(slog.LevelDebug, "skipping duplicate record",
+				slog.String("session", string(record.SessionID)),
+				slog.String("id", record.ID),
+			)
+			turn.Err = w.commit(checkpointer, record, nil, retry)
+			turns <- turn
+			continue
+		}
+		sessions.prune(time.Now())
+		if session, found = sessions.get(record.SessionID); !found {
 			session = NewSession(record.SessionID)
 		}
-		if session, err = w.process(session, record.Query); err != nil {
-			return
+		if record.Locale != "" {
+			session.Locale = record.Locale
 		}
-		sessions[record.SessionID] = session
-		// Non-blocking push onto channel.
-		select {
-		case requests <- record.SessionID:
-		default:
+		start = time.Now()
+		if out, turn.Messages, turn.Err = w.process(ctx, session, record.Query); turn.Err != nil {
+			w.log(slog.LevelError, "turn failed",
+				slog.String("session", string(record.SessionID)),
+				slog.Duration("duration", time.Since(start)),
+				slog.Any("error", turn.Err),
+			)
+			w.handler.Error(session, turn.Err.Error())
+		} else {
+			w.log(slog.LevelInfo, "turn complete",
+				slog.String("session", string(record.SessionID)),
+				slog.Int("messages", len(turn.Messages)),
+				slog.Duration("duration", time.Since(start)),
+			)
+			sessions.put(out, time.Now())
+		}
+		if w.Metrics != nil {
+			w.Metrics.SetActiveSessions(sessions.len())
+		}
+		if checkpointer != nil {
+			err = w.commit(checkpointer, record, turn.Err, retry)
+			if err != nil && turn.Err == nil {
+				turn.Err = err
+			}
+			err = nil
 		}
+		turns <- turn
 	}
+	err = ctx.Err()
 	return
 }
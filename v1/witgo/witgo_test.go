@@ -0,0 +1,438 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgo_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/kurrik/witgo/v1/witgo"
+	"github.com/kurrik/witgo/v1/witgo/witgotest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessContextCanceled(t *testing.T) {
+	var (
+		server      = witgotest.NewServer()
+		input       = witgotest.NewScriptedQueries("s", "hello", "again")
+		wg          = witgo.NewWitgo(server.Client, witgotest.NewMockHandler())
+		ctx, cancel = context.WithCancel(context.Background())
+		err         error
+	)
+	defer server.Close()
+	cancel()
+	if err = wg.ProcessContext(ctx, input); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	for _, turn := range input.Turns() {
+		if !errors.Is(turn.Err, context.Canceled) {
+			t.Errorf("Expected turn %q to be canceled, got %v", turn.Query, turn.Err)
+		}
+	}
+	if len(input.Turns()) != 2 || len(server.Requests()) != 0 {
+		t.Fatalf("Expected 2 unprocessed turns, got %v turns and %v requests", len(input.Turns()), len(server.Requests()))
+	}
+}
+
+func TestProcessPassesContextToHandler(t *testing.T) {
+	type key struct{}
+	var (
+		server  = witgotest.NewServer()
+		input   = witgotest.NewScriptedQueries("s", "hello")
+		handler = witgotest.NewMockHandler()
+		ctx     = context.WithValue(context.Background(), key{}, "parent")
+		got     interface{}
+	)
+	defer server.Close()
+	server.AddConverse("s",
+		&witgo.ConverseResponse{Type: "action", Action: "check"},
+		&witgo.ConverseResponse{Type: "stop"},
+	)
+	handler.OnAction("check", witgotest.MockResult{Func: func(session *witgo.Session, entities witgo.EntityMap) (*witgo.Session, error) {
+		got = session.Ctx().Value(key{})
+		return session, nil
+	}})
+	if err := witgo.NewWitgo(server.Client, handler).ProcessContext(ctx, input); err != nil {
+		t.Fatal(err)
+	}
+	if got != "parent" {
+		t.Fatalf("Expected the handler context to derive from ProcessContext, got %v", got)
+	}
+}
+
+func TestProcessRendersForRecordLocale(t *testing.T) {
+	var (
+		server    = witgotest.NewServer()
+		handler   = witgotest.NewMockHandler()
+		templates = witgo.NewMessageTemplates("en")
+		input     = witgotest.NewScriptedInput(
+			witgo.InputRecord{SessionID: "s", Query: "hola", Locale: "es-MX"},
+			witgo.InputRecord{SessionID: "s", Query: "hola"},
+		)
+		wg  = witgo.NewWitgo(server.Client, handler)
+		err error
+	)
+	defer server.Close()
+	server.AddConverse("s",
+		&witgo.ConverseResponse{Type: "msg", Msg: "greeting"},
+		&witgo.ConverseResponse{Type: "stop"},
+		&witgo.ConverseResponse{Type: "msg", Msg: "greeting"},
+		&witgo.ConverseResponse{Type: "stop"},
+	)
+	if err = templates.Add("en", "greeting", "Hello!"); err != nil {
+		t.Fatal(err)
+	}
+	if err = templates.Add("es", "greeting", "¡Hola!"); err != nil {
+		t.Fatal(err)
+	}
+	wg.Renderer = templates
+	if err = wg.Process(input); err != nil {
+		t.Fatal(err)
+	}
+	for i, turn := range input.Turns() {
+		if turn.Err != nil || len(turn.Messages) != 1 || turn.Messages[0] != "¡Hola!" {
+			t.Errorf("turn %v: got messages %q and error %v, want [\"¡Hola!\"]", i, turn.Messages, turn.Err)
+		}
+	}
+}
+
+// An Input which checks the Turn handshake: it sends a record only after the
+// previous one was acknowledged.
+type handshakeInput struct {
+	queries []string
+	turns   []witgo.Turn
+	closed  chan struct{}
+}
+
+func (i *handshakeInput) Run(turns <-chan witgo.Turn) <-chan witgo.InputRecord {
+	var records = make(chan witgo.InputRecord)
+	i.closed = make(chan struct{})
+	go func() {
+		for _, q := range i.queries {
+			records <- witgo.InputRecord{SessionID: "s", Query: q}
+			i.turns = append(i.turns, <-turns)
+		}
+		close(records)
+		for range turns {
+			i.turns = append(i.turns, witgo.Turn{})
+		}
+		close(i.closed)
+	}()
+	return records
+}
+
+func TestProcessAcknowledgesEveryRecord(t *testing.T) {
+	var tests = [][]string{
+		nil,
+		{"hello"},
+		{"one", "two", "three"},
+	}
+	for _, queries := range tests {
+		var (
+			server = witgotest.NewServer()
+			input  = &handshakeInput{queries: queries}
+		)
+		if err := witgo.NewWitgo(server.Client, witgotest.NewMockHandler()).Process(input); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		select {
+		case <-input.closed:
+		case <-time.After(time.Second):
+			t.Fatalf("%v: turns was not closed after Process returned", queries)
+		}
+		if len(input.turns) != len(queries) {
+			t.Errorf("%v: got %v turns, want %v", queries, len(input.turns), len(queries))
+			continue
+		}
+		for i, turn := range input.turns {
+			if turn.Query != queries[i] || turn.Err != nil {
+				t.Errorf("%v: turn %v: got %q and error %v", queries, i, turn.Query, turn.Err)
+			}
+		}
+	}
+}
+
+// A Handler which does not implement Sayer.
+type plainHandler struct{}
+
+func (plainHandler) Action(session *witgo.Session, entities witgo.EntityMap, action string) (*witgo.Session, error) {
+	return session, nil
+}
+
+func (plainHandler) Merge(session *witgo.Session, entities witgo.EntityMap) (*witgo.Session, error) {
+	return session, nil
+}
+
+func (plainHandler) Error(session *witgo.Session, msg string) {}
+
+// Records the messages delivered to it.
+type recordingResponder struct {
+	messages []string
+}
+
+func (r *recordingResponder) Respond(sessionID witgo.SessionID, msg string) error {
+	r.messages = append(r.messages, string(sessionID)+": "+msg)
+	return nil
+}
+
+// A ScriptedInput which also delivers messages.
+type respondingInput struct {
+	*witgotest.ScriptedInput
+	*recordingResponder
+}
+
+func TestProcessRoutesMessages(t *testing.T) {
+	var tests = []struct {
+		name        string
+		handler     witgo.Handler
+		witgo       *recordingResponder
+		input       *recordingResponder
+		wantWitgo   []string
+		wantInput   []string
+		wantSayer   []string
+		wantFailure bool
+	}{
+		{name: "input", handler: plainHandler{}, input: &recordingResponder{}, wantInput: []string{"s: Hi!"}},
+		{name: "witgo over input", handler: plainHandler{}, witgo: &recordingResponder{}, input: &recordingResponder{}, wantWitgo: []string{"s: Hi!"}},
+		{name: "sayer over responders", handler: witgotest.NewMockHandler(), witgo: &recordingResponder{}, input: &recordingResponder{}, wantSayer: []string{"Hi!"}},
+		{name: "nowhere", handler: plainHandler{}, wantFailure: true},
+	}
+	for _, test := range tests {
+		var (
+			server = witgotest.NewServer()
+			input  witgo.Input
+			turns  []witgo.Turn
+			wg     = witgo.NewWitgo(server.Client, test.handler)
+		)
+		scripted := witgotest.NewScriptedQueries("s", "hello")
+		server.AddConverse("s", &witgo.ConverseResponse{Type: "msg", Msg: "Hi!"})
+		if input = scripted; test.input != nil {
+			input = respondingInput{scripted, test.input}
+		}
+		if test.witgo != nil {
+			wg.Responder = test.witgo
+		}
+		if err := wg.Process(input); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		if turns = scripted.Turns(); len(turns) != 1 || (turns[0].Err != nil) != test.wantFailure {
+			t.Errorf("%v: got turns %+v, want failure %v", test.name, turns, test.wantFailure)
+		}
+		if test.witgo != nil && !reflect.DeepEqual(test.witgo.messages, test.wantWitgo) {
+			t.Errorf("%v: Witgo.Responder got %q, want %q", test.name, test.witgo.messages, test.wantWitgo)
+		}
+		if test.input != nil && !reflect.DeepEqual(test.input.messages, test.wantInput) {
+			t.Errorf("%v: input got %q, want %q", test.name, test.input.messages, test.wantInput)
+		}
+		if mock, ok := test.handler.(*witgotest.MockHandler); ok && !reflect.DeepEqual(mock.Messages(), test.wantSayer) {
+			t.Errorf("%v: Sayer got %q, want %q", test.name, mock.Messages(), test.wantSayer)
+		}
+	}
+}
+
+// A ScriptedInput which resumes from a checkpoint.
+type checkpointedInput struct {
+	*witgotest.ScriptedInput
+	checkpointer *witgo.Checkpointer
+}
+
+func (i checkpointedInput) Checkpointer() *witgo.Checkpointer {
+	return i.checkpointer
+}
+
+func TestProcessCommitsCheckpoints(t *testing.T) {
+	var (
+		server  = witgotest.NewServer()
+		handler = witgotest.NewMockHandler()
+		store   = &witgo.MemoryCheckpointStore{}
+		errs    = map[witgo.SessionID]error{
+			"s2": witgo.ResponseError{Code: 503},
+			"s3": witgo.ResponseError{Code: 400},
+		}
+		committed []string
+		cp        *witgo.Checkpointer
+		input     checkpointedInput
+		err       error
+	)
+	defer server.Close()
+	handler.OnAction("work", witgotest.MockResult{Func: func(session *witgo.Session, entities witgo.EntityMap) (*witgo.Session, error) {
+		if id := strings.TrimPrefix(string(session.ID()), "s"); cp.Seen(id) {
+			committed = append(committed, id)
+		}
+		return session, errs[session.ID()]
+	}})
+	record := func(id string) witgo.InputRecord {
+		server.AddConverse(witgo.SessionID("s"+id),
+			&witgo.ConverseResponse{Type: "action", Action: "work"},
+			&witgo.ConverseResponse{Type: "stop"},
+		)
+		return witgo.InputRecord{SessionID: witgo.SessionID("s" + id), Query: "q", ID: id, Position: id}
+	}
+	if cp, err = witgo.NewCheckpointer(store); err != nil {
+		t.Fatal(err)
+	}
+	if err = cp.Commit(witgo.InputRecord{ID: "0", Position: "0"}); err != nil {
+		t.Fatal(err)
+	}
+	input = checkpointedInput{witgotest.NewScriptedInput(
+		witgo.InputRecord{SessionID: "s0", Query: "q", ID: "0", Position: "0"},
+		record("1"), record("2"), record("3"), record("4"),
+	), cp}
+	if err = witgo.NewWitgo(server.Client, handler).Process(input); err != nil {
+		t.Fatal(err)
+	}
+	if turn := input.Turns()[0]; !turn.Duplicate || len(server.RequestsFor("/converse")) != 6 {
+		t.Errorf("Expected the committed record to be skipped, got %+v", turn)
+	}
+	if len(committed) != 0 {
+		t.Errorf("Expected records to be committed after their turn, got %v during the turn", committed)
+	}
+	if cp.Position() != "1" || !cp.Seen("1") || cp.Seen("2") || !cp.Seen("3") || !cp.Seen("4") {
+		t.Errorf("Expected only the retryable failure to stay uncommitted, got position %q", cp.Position())
+	}
+
+	// After a restart the input resumes after position 1.
+	delete(errs, "s2")
+	if cp, err = witgo.NewCheckpointer(store); err != nil {
+		t.Fatal(err)
+	}
+	input = checkpointedInput{witgotest.NewScriptedInput(
+		witgo.InputRecord{SessionID: "s2", Query: "q", ID: "2", Position: "2"},
+		witgo.InputRecord{SessionID: "s3", Query: "q", ID: "3", Position: "3"},
+		witgo.InputRecord{SessionID: "s4", Query: "q", ID: "4", Position: "4"},
+	), cp}
+	if err = witgo.NewWitgo(server.Client, handler).Process(input); err != nil {
+		t.Fatal(err)
+	}
+	for i, turn := range input.Turns() {
+		if turn.Err != nil || turn.Duplicate != (i > 0) {
+			t.Errorf("turn %v: got duplicate %v and error %v", i, turn.Duplicate, turn.Err)
+		}
+	}
+	if cp.Position() != "4" || !cp.Seen("2") {
+		t.Errorf("got position %q, want \"4\"", cp.Position())
+	}
+}
+
+// Records the input backlog reported to it.
+type backlogMetrics struct {
+	*witgo.ExpvarMetrics
+	backlog []int
+}
+
+func (m *backlogMetrics) SetInputBacklog(count int) {
+	m.backlog = append(m.backlog, count)
+	m.ExpvarMetrics.SetInputBacklog(count)
+}
+
+func TestProcessReportsInputBacklog(t *testing.T) {
+	var (
+		server  = witgotest.NewServer()
+		input   = witgotest.NewScriptedQueries("s", "one", "two", "three")
+		metrics = &backlogMetrics{ExpvarMetrics: witgo.NewExpvarMetrics("")}
+		wg      = witgo.NewWitgo(server.Client, witgotest.NewMockHandler())
+		buf     = &bytes.Buffer{}
+	)
+	defer server.Close()
+	wg.Metrics = metrics
+	if err := wg.Process(input); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{2, 1, 0}; !reflect.DeepEqual(metrics.backlog, want) {
+		t.Errorf("got backlog %v, want %v", metrics.backlog, want)
+	}
+	metrics.WritePrometheus(buf)
+	if !strings.Contains(buf.String(), "witgo_input_backlog 0\n") {
+		t.Errorf("Expected the backlog gauge, got:\n%v", buf)
+	}
+}
+
+// A Tracer which records every span and its parent.
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	name   string
+	parent *fakeSpan
+	ended  bool
+}
+
+type spanKey struct{}
+
+func (t *fakeTracer) Start(ctx context.Context, name string) (context.Context, witgo.Span) {
+	var span = &fakeSpan{name: name}
+	span.parent, _ = ctx.Value(spanKey{}).(*fakeSpan)
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) {}
+func (s *fakeSpan) RecordError(err error)                      {}
+func (s *fakeSpan) End()                                       { s.ended = true }
+
+func TestProcessSpanTree(t *testing.T) {
+	var (
+		server  = witgotest.NewServer()
+		handler = witgotest.NewMockHandler()
+		tracer  = &fakeTracer{}
+		wg      = witgo.NewWitgo(server.Client, handler)
+		got     []string
+		want    = []string{
+			"witgo.turn",
+			"witgo.turn > wit.ai /converse",
+			"witgo.turn > witgo.merge",
+			"witgo.turn > wit.ai /converse",
+			"witgo.turn > witgo.action check",
+			"witgo.turn > wit.ai /converse",
+			"witgo.turn > witgo.say",
+			"witgo.turn > wit.ai /converse",
+		}
+	)
+	defer server.Close()
+	server.AddConverse("s",
+		&witgo.ConverseResponse{Type: "merge"},
+		&witgo.ConverseResponse{Type: "action", Action: "check"},
+		&witgo.ConverseResponse{Type: "msg", Msg: "Hi"},
+		&witgo.ConverseResponse{Type: "stop"},
+	)
+	server.Client.Tracer = tracer
+	wg.Tracer = tracer
+	if err := wg.Process(witgotest.NewScriptedQueries("s", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, span := range tracer.spans {
+		var name = span.name
+		if span.parent != nil {
+			name = span.parent.name + " > " + name
+		}
+		if !span.ended {
+			t.Errorf("Expected span %q to end", name)
+		}
+		got = append(got, name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got spans %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgotest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kurrik/witgo/v1/witgo"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Something that happened while Witgo processed a turn.  Context is a
+// snapshot of the session context after the event.
+type Event struct {
+	Type     string
+	Action   string
+	Msg      string
+	Entities witgo.EntityMap
+	Context  witgo.Context
+}
+
+func formatEntities(entities witgo.EntityMap) string {
+	var (
+		keys  []string
+		parts []string
+		key   string
+	)
+	for key = range entities {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key = range keys {
+		for _, entity := range entities[key] {
+			parts = append(parts, fmt.Sprintf("%v=%v", key, entity.Value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (e Event) String() string {
+	switch e.Type {
+	case "action":
+		return strings.TrimSpace(fmt.Sprintf("action %v %v", e.Action, formatEntities(e.Entities)))
+	case "merge":
+		return strings.TrimSpace(fmt.Sprintf("merge %v", formatEntities(e.Entities)))
+	case "say":
+		return fmt.Sprintf("say %q", e.Msg)
+	case "error":
+		return fmt.Sprintf("error %q", e.Msg)
+	}
+	return e.Type
+}
+
+// The events of a single user turn and the session context once it finished.
+type TranscriptTurn struct {
+	Query   string
+	Events  []Event
+	Context witgo.Context
+	Err     error
+}
+
+type Transcript []*TranscriptTurn
+
+func (t Transcript) String() string {
+	var (
+		buf  = &bytes.Buffer{}
+		turn *TranscriptTurn
+	)
+	for _, turn = range t {
+		fmt.Fprintf(buf, "user %q\n", turn.Query)
+		for _, event := range turn.Events {
+			fmt.Fprintf(buf, "  %v\n", event)
+		}
+	}
+	return buf.String()
+}
+
+func copyContext(ctx witgo.Context) witgo.Context {
+	var out = witgo.Context{}
+	for key, value := range ctx {
+		out[key] = value
+	}
+	return out
+}
+
+// Wraps a Handler and records every callback.  session is the last session
+// a callback returned; the engine may still change its Context after the
+// callback.
+type recordingHandler struct {
+	handler witgo.Handler
+	mu      sync.Mutex
+	events  []Event
+	session *witgo.Session
+}
+
+func (h *recordingHandler) record(event Event, session *witgo.Session) {
+	if session != nil {
+		event.Context = copyContext(session.Context)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+	if session != nil {
+		h.session = session
+	}
+}
+
+// Returns and clears the events and the session recorded so far.
+func (h *recordingHandler) take() (events []Event, session *witgo.Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events, h.events = h.events, nil
+	session, h.session = h.session, nil
+	return
+}
+
+func (h *recordingHandler) Action(session *witgo.Session, entities witgo.EntityMap, action string) (response *witgo.Session, err error) {
+	response, err = h.handler.Action(session, entities, action)
+	h.record(Event{Type: "action", Action: action, Entities: entities}, response)
+	return
+}
+
+func (h *recordingHandler) Merge(session *witgo.Session, entities witgo.EntityMap) (response *witgo.Session, err error) {
+	response, err = h.handler.Merge(session, entities)
+	h.record(Event{Type: "merge", Entities: entities}, response)
+	return
+}
+
+func (h *recordingHandler) Say(session *witgo.Session, msg string) (response *witgo.Session, err error) {
+	var (
+		sayer witgo.Sayer
+		ok    bool
+	)
+	response = session
+	if sayer, ok = h.handler.(witgo.Sayer); ok {
+		response, err = sayer.Say(session, msg)
+	}
+	h.record(Event{Type: "say", Msg: msg}, response)
+	return
+}
+
+func (h *recordingHandler) Error(session *witgo.Session, msg string) {
+	h.handler.Error(session, msg)
+	h.record(Event{Type: "error", Msg: msg}, session)
+}
+
+type expectation struct {
+	kind     string
+	action   string
+	msg      string
+	entities []string
+	key      string
+	value    interface{}
+	anyValue bool
+}
+
+func (e *expectation) String() string {
+	switch e.kind {
+	case "action":
+		return strings.TrimSpace(fmt.Sprintf("action %v %v", e.action, strings.Join(e.entities, " ")))
+	case "merge":
+		return strings.TrimSpace(fmt.Sprintf("merge %v", strings.Join(e.entities, " ")))
+	case "say":
+		return fmt.Sprintf("say %q", e.msg)
+	case "context":
+		if e.anyValue {
+			return fmt.Sprintf("context %v set", e.key)
+		}
+		return fmt.Sprintf("context %v=%v", e.key, e.value)
+	}
+	return e.kind
+}
+
+func sameValue(a interface{}, b interface{}) bool {
+	return reflect.DeepEqual(a, b) || fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func hasEntity(entities witgo.EntityMap, pair string) bool {
+	var parts = strings.SplitN(pair, "=", 2)
+	for _, entity := range entities[parts[0]] {
+		if len(parts) == 1 || entity.Value == parts[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *expectation) matches(event Event) bool {
+	if e.kind != event.Type {
+		return false
+	}
+	switch e.kind {
+	case "action":
+		if e.action != event.Action {
+			return false
+		}
+	case "say":
+		return e.msg == event.Msg
+	}
+	for _, pair := range e.entities {
+		if !hasEntity(event.Entities, pair) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *expectation) matchesContext(ctx witgo.Context) bool {
+	var (
+		value interface{}
+		found bool
+	)
+	if value, found = ctx[e.key]; !found {
+		return false
+	}
+	return e.anyValue || sameValue(e.value, value)
+}
+
+type scriptTurn struct {
+	query  string
+	expect []*expectation
+}
+
+// Returned by Conversation.Run when the transcript does not match the script.
+type MismatchError struct {
+	Transcript Transcript
+	Diff       string
+}
+
+func (e *MismatchError) Error() string {
+	return "Conversation did not match script:\n" + e.Diff
+}
+
+// Scripts a conversation with a bot and checks what it does.  For example:
+//
+//	conv := witgotest.NewConversation(server.Client, handler)
+//	conv.User("What's the weather in Paris?").
+//		ExpectAction("getForecast", "location=Paris").
+//		ExpectSay("It's sunny in Paris").
+//		ExpectContext("forecast", "sunny")
+//	if _, err := conv.Run(); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// Within a turn, expected events must occur in order but other events may be
+// interleaved.  Context expectations are checked once the turn has finished.
+type Conversation struct {
+	Client    *witgo.Client
+	Handler   witgo.Handler
+	SessionID witgo.SessionID
+	// Drives the dialogue.  Nil uses the default engine of Witgo.
+	Engine witgo.Engine
+
+	turns []*scriptTurn
+}
+
+func NewConversation(client *witgo.Client, handler witgo.Handler) *Conversation {
+	return &Conversation{
+		Client:    client,
+		Handler:   handler,
+		SessionID: "witgotest",
+	}
+}
+
+func (c *Conversation) expect(e *expectation) *Conversation {
+	var turn *scriptTurn
+	if len(c.turns) == 0 {
+		panic("witgotest: expectation added before the first User turn")
+	}
+	turn = c.turns[len(c.turns)-1]
+	turn.expect = append(turn.expect, e)
+	return c
+}
+
+// Starts a new turn in which the user sends q.
+func (c *Conversation) User(q string) *Conversation {
+	c.turns = append(c.turns, &scriptTurn{query: q})
+	return c
+}
+
+// Expects the action to be run.  Entities are given as "key=value", or just
+// "key" to accept any value.
+func (c *Conversation) ExpectAction(action string, entities ...string) *Conversation {
+	return c.expect(&expectation{kind: "action", action: action, entities: entities})
+}
+
+// Expects a merge with the entities, given as for ExpectAction.
+func (c *Conversation) ExpectMerge(entities ...string) *Conversation {
+	return c.expect(&expectation{kind: "merge", entities: entities})
+}
+
+// Expects the bot to say msg.
+func (c *Conversation) ExpectSay(msg string) *Conversation {
+	return c.expect(&expectation{kind: "say", msg: msg})
+}
+
+// Expects the context to contain key with value at the end of the turn.
+func (c *Conversation) ExpectContext(key string, value interface{}) *Conversation {
+	return c.expect(&expectation{kind: "context", key: key, value: value})
+}
+
+// Expects the context to contain key, with any value, at the end of the turn.
+func (c *Conversation) ExpectContextKey(key string) *Conversation {
+	return c.expect(&expectation{kind: "context", key: key, anyValue: true})
+}
+
+// Compares a turn with the script, returning a description of any mismatch.
+func diffTurn(index int, script *scriptTurn, turn *TranscriptTurn) string {
+	var (
+		buf     = &bytes.Buffer{}
+		matched = make([]bool, len(turn.Events))
+		missing []string
+		next    int
+		e       *expectation
+		i       int
+	)
+	for _, e = range script.expect {
+		if e.kind == "context" {
+			if !e.matchesContext(turn.Context) {
+				missing = append(missing, fmt.Sprintf("%v, got %v=%v", e, e.key, turn.Context[e.key]))
+			}
+			continue
+		}
+		for i = next; i < len(turn.Events); i++ {
+			if e.matches(turn.Events[i]) {
+				break
+			}
+		}
+		if i == len(turn.Events) {
+			missing = append(missing, e.String())
+			continue
+		}
+		matched[i] = true
+		next = i + 1
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+	fmt.Fprintf(buf, "turn %v: user %q\n", index+1, script.query)
+	for i = range turn.Events {
+		if matched[i] {
+			fmt.Fprintf(buf, "    %v\n", turn.Events[i])
+		} else {
+			fmt.Fprintf(buf, "  + %v\n", turn.Events[i])
+		}
+	}
+	for _, line := range missing {
+		fmt.Fprintf(buf, "  - %v\n", line)
+	}
+	return buf.String()
+}
+
+// Plays the script through Witgo and returns the transcript.  If it does not
+// match the script, err is a *MismatchError whose Diff lists unexpected
+// events with "+" and missing expectations with "-".
+func (c *Conversation) Run() (transcript Transcript, err error) {
+	var (
+		recorder = &recordingHandler{handler: c.Handler}
+		input    = NewScriptedInput()
+		wg       = witgo.NewWitgo(c.Client, recorder)
+		script   *scriptTurn
+		turn     *TranscriptTurn
+		session  *witgo.Session
+		last     = witgo.Context{}
+		diff     string
+		i        int
+	)
+	wg.Engine = c.Engine
+	for _, script = range c.turns {
+		input.Add(witgo.InputRecord{SessionID: c.SessionID, Query: script.query})
+	}
+	input.OnTurn = func(t witgo.Turn) {
+		turn = &TranscriptTurn{
+			Query:   t.Query,
+			Context: last,
+			Err:     t.Err,
+		}
+		if turn.Events, session = recorder.take(); session != nil {
+			turn.Context = copyContext(session.Context)
+		}
+		last = turn.Context
+		transcript = append(transcript, turn)
+	}
+	if err = wg.Process(input); err != nil {
+		return
+	}
+	for i, script = range c.turns {
+		diff += diffTurn(i, script, transcript[i])
+	}
+	if diff != "" {
+		err = &MismatchError{Transcript: transcript, Diff: diff}
+	}
+	return
+}
@@ -0,0 +1,166 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgotest
+
+import (
+	"errors"
+	"github.com/kurrik/witgo/v1/witgo"
+	"strings"
+	"testing"
+)
+
+// Starts a server scripted with a weather conversation for the default
+// Conversation session.
+func newWeatherServer() *Server {
+	var server = NewServer()
+	server.AddConverse("witgotest",
+		&witgo.ConverseResponse{Type: "merge", Entities: witgo.EntityMap{"location": {{Value: "Paris", Confidence: 1}}}},
+		&witgo.ConverseResponse{Type: "action", Action: "getForecast"},
+		&witgo.ConverseResponse{Type: "msg", Msg: "It's sunny in Paris"},
+		&witgo.ConverseResponse{Type: "stop"},
+		&witgo.ConverseResponse{Type: "msg", Msg: "Bye!"},
+		&witgo.ConverseResponse{Type: "stop"},
+	)
+	return server
+}
+
+func newWeatherHandler() *MockHandler {
+	return NewMockHandler().
+		OnMerge(MockResult{Set: witgo.Context{"loc": "Paris"}}).
+		OnAction("getForecast", MockResult{Set: witgo.Context{"forecast": "sunny"}})
+}
+
+func TestConversation(t *testing.T) {
+	var tests = []struct {
+		name   string
+		script func(c *Conversation)
+		diff   []string
+	}{
+		{
+			name: "match",
+			script: func(c *Conversation) {
+				c.User("What's the weather in Paris?").
+					ExpectMerge("location=Paris").
+					ExpectAction("getForecast").
+					ExpectSay("It's sunny in Paris").
+					ExpectContext("forecast", "sunny").
+					ExpectContextKey("loc").
+					User("Thanks").
+					ExpectSay("Bye!")
+			},
+		},
+		{
+			name: "events may be interleaved",
+			script: func(c *Conversation) {
+				c.User("What's the weather in Paris?").
+					ExpectSay("It's sunny in Paris").
+					User("Thanks")
+			},
+		},
+		{
+			name: "missing and unexpected events",
+			script: func(c *Conversation) {
+				c.User("What's the weather in Paris?").
+					ExpectAction("getForecast", "location=Lyon").
+					ExpectSay("It's sunny in Paris").
+					ExpectContext("forecast", "rainy").
+					User("Thanks").
+					ExpectSay("Bye!")
+			},
+			diff: []string{
+				"turn 1:",
+				"  + action getForecast",
+				"    say \"It's sunny in Paris\"",
+				"  - action getForecast location=Lyon",
+				"  - context forecast=rainy, got forecast=sunny",
+			},
+		},
+		{
+			name: "out of order",
+			script: func(c *Conversation) {
+				c.User("What's the weather in Paris?").
+					ExpectSay("It's sunny in Paris").
+					ExpectAction("getForecast")
+			},
+			diff: []string{"turn 1:", "  - action getForecast"},
+		},
+	}
+	for _, test := range tests {
+		var (
+			server   = newWeatherServer()
+			conv     = NewConversation(server.Client, newWeatherHandler())
+			mismatch *MismatchError
+			err      error
+		)
+		test.script(conv)
+		_, err = conv.Run()
+		server.Close()
+		if len(test.diff) == 0 {
+			if err != nil {
+				t.Errorf("%v: got error %v", test.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &mismatch) {
+			t.Errorf("%v: got error %v, want a *MismatchError", test.name, err)
+			continue
+		}
+		for _, line := range test.diff {
+			if !strings.Contains(mismatch.Diff, line) {
+				t.Errorf("%v: got diff\n%v\nwant it to contain %q", test.name, mismatch.Diff, line)
+			}
+		}
+		if strings.Contains(mismatch.Diff, "turn 2:") {
+			t.Errorf("%v: got diff\n%v\nwant only turn 1 to mismatch", test.name, mismatch.Diff)
+		}
+	}
+}
+
+func TestConversationRequiresUserTurn(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected an expectation before the first turn to panic")
+		}
+	}()
+	NewConversation(nil, nil).ExpectSay("hi")
+}
+
+// The Flow moves to the next state after the last Handler callback of the
+// turn, so the turn's Context must be read once the turn has finished.
+func TestConversationContextAfterTurn(t *testing.T) {
+	var (
+		server  = NewServer()
+		handler = NewMockHandler()
+		flow    = &witgo.Flow{Start: "idle", States: map[string]*witgo.FlowState{
+			"idle": {Transitions: []*witgo.FlowTransition{
+				{Intent: "hello", To: "greet"},
+			}},
+			"greet": {Say: []string{"Hello!"}, Next: "idle"},
+		}}
+		conv *Conversation
+	)
+	defer server.Close()
+	server.AddMessage("Hi", &witgo.MessageResponse{
+		Intents: []*witgo.MessageIntent{{Name: "hello", Confidence: 1}},
+	})
+	conv = NewConversation(server.Client, handler)
+	conv.Engine = flow
+	conv.User("Hi").
+		ExpectSay("Hello!").
+		ExpectContext(witgo.FLOW_STATE, "idle")
+	if _, err := conv.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgotest
+
+import (
+	"github.com/kurrik/witgo/v1/witgo"
+	"sync"
+)
+
+// A call made to a MockHandler.  Context is a snapshot of the session context
+// when the call was made.
+type Call struct {
+	Method    string
+	SessionID witgo.SessionID
+	Action    string
+	Entities  witgo.EntityMap
+	Msg       string
+	Context   witgo.Context
+}
+
+// Canned result of a MockHandler callback.  Set is merged into the session
+// context and Delete removed from it, then Err is returned.  If Func is set it
+// is called instead.
+type MockResult struct {
+	Set    witgo.Context
+	Delete []string
+	Err    error
+	Func   func(session *witgo.Session, entities witgo.EntityMap) (*witgo.Session, error)
+}
+
+func (r *MockResult) apply(session *witgo.Session, entities witgo.EntityMap) (response *witgo.Session, err error) {
+	if r == nil {
+		return session, nil
+	}
+	if r.Func != nil {
+		return r.Func(session, entities)
+	}
+	response = session
+	response.Context.Merge(r.Set)
+	for _, key := range r.Delete {
+		delete(response.Context, key)
+	}
+	err = r.Err
+	return
+}
+
+// A Handler which records every call and returns canned results.  Actions
+// without a result leave the session unchanged.  Safe for concurrent use.
+type MockHandler struct {
+	mu      sync.Mutex
+	calls   []Call
+	actions map[string]*MockResult
+	merge   *MockResult
+	say     *MockResult
+}
+
+func NewMockHandler() *MockHandler {
+	return &MockHandler{
+		actions: map[string]*MockResult{},
+	}
+}
+
+// Sets the result of an action.
+func (h *MockHandler) OnAction(action string, result MockResult) *MockHandler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.actions[action] = &result
+	return h
+}
+
+// Sets the result of every merge.
+func (h *MockHandler) OnMerge(result MockResult) *MockHandler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.merge = &result
+	return h
+}
+
+// Sets the result of every message said.
+func (h *MockHandler) OnSay(result MockResult) *MockHandler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.say = &result
+	return h
+}
+
+func (h *MockHandler) record(call Call, session *witgo.Session) {
+	if session != nil {
+		call.SessionID = session.ID()
+		call.Context = copyContext(session.Context)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = append(h.calls, call)
+}
+
+func (h *MockHandler) result(get func() *MockResult) *MockResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return get()
+}
+
+func (h *MockHandler) Action(session *witgo.Session, entities witgo.EntityMap, action string) (*witgo.Session, error) {
+	h.record(Call{Method: "Action", Action: action, Entities: entities}, session)
+	return h.result(func() *MockResult { return h.actions[action] }).apply(session, entities)
+}
+
+func (h *MockHandler) Merge(session *witgo.Session, entities witgo.EntityMap) (*witgo.Session, error) {
+	h.record(Call{Method: "Merge", Entities: entities}, session)
+	return h.result(func() *MockResult { return h.merge }).apply(session, entities)
+}
+
+func (h *MockHandler) Say(session *witgo.Session, msg string) (*witgo.Session, error) {
+	h.record(Call{Method: "Say", Msg: msg}, session)
+	return h.result(func() *MockResult { return h.say }).apply(session, nil)
+}
+
+func (h *MockHandler) Error(session *witgo.Session, msg string) {
+	h.record(Call{Method: "Error", Msg: msg}, session)
+}
+
+// Returns every call made so far, oldest first.
+func (h *MockHandler) Calls() []Call {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Call{}, h.calls...)
+}
+
+// Returns the calls made to one method, such as "Action".
+func (h *MockHandler) CallsTo(method string) (out []Call) {
+	for _, call := range h.Calls() {
+		if call.Method == method {
+			out = append(out, call)
+		}
+	}
+	return
+}
+
+// Returns the names of the actions run so far, in order.
+func (h *MockHandler) Actions() (out []string) {
+	for _, call := range h.CallsTo("Action") {
+		out = append(out, call.Action)
+	}
+	return
+}
+
+// Returns the messages said so far, in order.
+func (h *MockHandler) Messages() (out []string) {
+	for _, call := range h.CallsTo("Say") {
+		out = append(out, call.Msg)
+	}
+	return
+}
+
+// Clears the recorded calls.
+func (h *MockHandler) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = nil
+}
+
+// An Input which sends fixed records one at a time, waiting for the turn of
+// each before sending the next.  Safe for concurrent use.  A script runs
+// once; later calls to Run return a closed records channel.
+type ScriptedInput struct {
+	// Called with each turn as it is received.
+	OnTurn func(turn witgo.Turn)
+
+	mu      sync.Mutex
+	records []witgo.InputRecord
+	sent    int
+	turns   []witgo.Turn
+	done    chan struct{}
+	ran     bool
+}
+
+func NewScriptedInput(records ...witgo.InputRecord) *ScriptedInput {
+	return &ScriptedInput{
+		records: records,
+		done:    make(chan struct{}),
+	}
+}
+
+// Creates a ScriptedInput sending each query for a single session.
+func NewScriptedQueries(sessionID witgo.SessionID, queries ...string) *ScriptedInput {
+	var records []witgo.InputRecord
+	for _, q := range queries {
+		records = append(records, witgo.InputRecord{SessionID: sessionID, Query: q})
+	}
+	return NewScriptedInput(records...)
+}
+
+// Appends a record.  Must be called before Run.
+func (i *ScriptedInput) Add(record witgo.InputRecord) *ScriptedInput {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.records = append(i.records, record)
+	return i
+}
+
+func (i *ScriptedInput) Run(turns <-chan witgo.Turn) <-chan witgo.InputRecord {
+	var (
+		records = make(chan witgo.InputRecord)
+		script  []witgo.InputRecord
+		ran     bool
+		done    chan struct{}
+	)
+	i.mu.Lock()
+	script = append(script, i.records...)
+	ran, i.ran = i.ran, true
+	done = i.doneLocked()
+	i.mu.Unlock()
+	if ran {
+		close(records)
+		go func() {
+			for range turns {
+			}
+		}()
+		return records
+	}
+	go func() {
+		var (
+			turn witgo.Turn
+			ok   bool
+		)
+		defer func() {
+			close(records)
+			for range turns {
+			}
+			close(done)
+		}()
+		for _, record := range script {
+			i.mu.Lock()
+			i.sent++
+			i.mu.Unlock()
+			records <- record
+			if turn, ok = <-turns; !ok {
+				return
+			}
+			i.mu.Lock()
+			i.turns = append(i.turns, turn)
+			i.mu.Unlock()
+			if i.OnTurn != nil {
+				i.OnTurn(turn)
+			}
+		}
+	}()
+	return records
+}
+
+// Returns the number of records not yet sent.
+func (i *ScriptedInput) Backlog() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.records) - i.sent
+}
+
+// Returns the turns received so far, oldest first.
+func (i *ScriptedInput) Turns() []witgo.Turn {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]witgo.Turn{}, i.turns...)
+}
+
+// Returns the done channel, creating it for a zero ScriptedInput.  Must be
+// called with the lock held.
+func (i *ScriptedInput) doneLocked() chan struct{} {
+	if i.done == nil {
+		i.done = make(chan struct{})
+	}
+	return i.done
+}
+
+// Closed once every record has been sent and Witgo has closed turns.
+func (i *ScriptedInput) Done() <-chan struct{} {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.doneLocked()
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgotest
+
+import (
+	"github.com/kurrik/witgo/v1/witgo"
+	"testing"
+)
+
+func TestScriptedInputRunsOnce(t *testing.T) {
+	var (
+		input   = NewScriptedQueries("s", "hello")
+		turns   = make(chan witgo.Turn)
+		records = input.Run(turns)
+		record  = <-records
+	)
+	turns <- witgo.Turn{InputRecord: record}
+	if _, ok := <-records; ok {
+		t.Fatal("Expected records to be closed after the script")
+	}
+	close(turns)
+	<-input.Done()
+	again := make(chan witgo.Turn)
+	if _, ok := <-input.Run(again); ok {
+		t.Fatal("Expected a second Run to return a closed channel")
+	}
+	close(again)
+	if len(input.Turns()) != 1 {
+		t.Fatalf("Expected one turn, got %v", input.Turns())
+	}
+}
+
+func TestZeroScriptedInput(t *testing.T) {
+	var (
+		input ScriptedInput
+		turns = make(chan witgo.Turn)
+	)
+	if _, ok := <-input.Run(turns); ok {
+		t.Fatal("Expected an empty script")
+	}
+	close(turns)
+	<-input.Done()
+}
@@ -0,0 +1,302 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Provides an in-process fake of the wit.ai API for testing bots.
+package witgotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kurrik/witgo/v1/witgo"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const DefaultToken = "witgotest-token"
+
+// A request received by the fake server.  Q and SessionID are copied from the
+// query string, Context is the decoded body of /converse requests.
+type Request struct {
+	Method    string
+	Path      string
+	Query     url.Values
+	Header    http.Header
+	Body      []byte
+	Q         string
+	SessionID witgo.SessionID
+	Context   witgo.Context
+}
+
+// Serves /message, /converse and the /entities management endpoints from
+// scripted fixtures and records every request it receives.
+type Server struct {
+	*httptest.Server
+
+	// Client with Base pointed at the server and a matching token.
+	Client *witgo.Client
+	// Requests without this bearer token are rejected with a 401.
+	Token string
+
+	mu       sync.Mutex
+	requests []*Request
+	messages map[string]*witgo.MessageResponse
+	converse map[witgo.SessionID][]*witgo.ConverseResponse
+	entities map[string]*witgo.Entity
+	msgID    int
+}
+
+// Starts a fake server.  Call Close when done.
+func NewServer() *Server {
+	var s = &Server{
+		Token:    DefaultToken,
+		messages: map[string]*witgo.MessageResponse{},
+		converse: map[witgo.SessionID][]*witgo.ConverseResponse{},
+		entities: map[string]*witgo.Entity{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.Client = witgo.NewClient(s.Token, witgo.WithBaseURL(s.URL))
+	return s
+}
+
+// Sets the response to /message for the query q.  Unknown queries return no
+// entities.
+func (s *Server) AddMessage(q string, response *witgo.MessageResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[q] = response
+}
+
+// Queues steps returned by successive /converse calls for a session.  Steps
+// added for the empty session ID are used by any session whose own queue is
+// empty.  Once every queue is empty, /converse returns a stop step.
+func (s *Server) AddConverse(sessionID witgo.SessionID, steps ...*witgo.ConverseResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.converse[sessionID] = append(s.converse[sessionID], steps...)
+}
+
+// Adds an entity served by the management endpoints.
+func (s *Server) AddEntity(entity *witgo.Entity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entities[entityID(entity)] = entity
+}
+
+// Returns every request received so far, oldest first.
+func (s *Server) Requests() []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Request{}, s.requests...)
+}
+
+// Returns the requests received for a path, oldest first.
+func (s *Server) RequestsFor(path string) (out []*Request) {
+	var req *Request
+	for _, req = range s.Requests() {
+		if req.Path == path {
+			out = append(out, req)
+		}
+	}
+	return
+}
+
+func entityID(entity *witgo.Entity) string {
+	if entity.ID != "" {
+		return entity.ID
+	}
+	return entity.Name
+}
+
+func (s *Server) record(r *http.Request) (req *Request, err error) {
+	req = &Request{
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Query:     r.URL.Query(),
+		Header:    r.Header,
+		Q:         r.URL.Query().Get("q"),
+		SessionID: witgo.SessionID(r.URL.Query().Get("session_id")),
+	}
+	if req.Body, err = ioutil.ReadAll(r.Body); err != nil {
+		return
+	}
+	if req.Path == "/converse" && len(req.Body) > 0 {
+		err = json.Unmarshal(req.Body, &req.Context)
+	}
+	s.requests = append(s.requests, req)
+	return
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data)
+}
+
+// Writes an error body in the format used by wit.ai.
+func writeError(w http.ResponseWriter, code int, witCode string, msg string) {
+	writeJSON(w, code, map[string]string{
+		"error": msg,
+		"code":  witCode,
+	})
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		req *Request
+		err error
+	)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req, err = s.record(r); err != nil {
+		writeError(w, http.StatusBadRequest, "bad-request", err.Error())
+		return
+	}
+	if r.Header.Get("Authorization") != fmt.Sprintf("Bearer %v", s.Token) {
+		writeError(w, http.StatusUnauthorized, "no-auth", "Bad auth, check token/params")
+		return
+	}
+	switch {
+	case req.Path == "/message" && req.Method == "GET":
+		s.serveMessage(w, req)
+	case req.Path == "/converse" && req.Method == "POST":
+		s.serveConverse(w, req)
+	case req.Path == "/entities" || strings.HasPrefix(req.Path, "/entities/"):
+		s.serveEntities(w, req)
+	default:
+		writeError(w, http.StatusNotFound, "not-found", fmt.Sprintf("Unknown endpoint %v %v", req.Method, req.Path))
+	}
+}
+
+func (s *Server) serveMessage(w http.ResponseWriter, req *Request) {
+	var (
+		response *witgo.MessageResponse
+		found    bool
+		out      witgo.MessageResponse
+	)
+	s.msgID++
+	if response, found = s.messages[req.Q]; found {
+		out = *response
+	}
+	if out.MsgID == "" {
+		out.MsgID = fmt.Sprintf("witgotest-%v", s.msgID)
+	}
+	out.Text = req.Q
+	if out.Entities == nil {
+		out.Entities = witgo.EntityMap{}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) serveConverse(w http.ResponseWriter, req *Request) {
+	var (
+		id   = req.SessionID
+		step *witgo.ConverseResponse
+	)
+	if len(s.converse[id]) == 0 {
+		id = ""
+	}
+	if len(s.converse[id]) == 0 {
+		writeJSON(w, http.StatusOK, &witgo.ConverseResponse{Type: "stop"})
+		return
+	}
+	step, s.converse[id] = s.converse[id][0], s.converse[id][1:]
+	writeJSON(w, http.StatusOK, step)
+}
+
+// Serves a subset of the entity management API:
+//
+//	GET    /entities
+//	POST   /entities
+//	GET    /entities/:id
+//	PUT    /entities/:id
+//	DELETE /entities/:id
+//	POST   /entities/:id/values
+//	DELETE /entities/:id/values/:value
+func (s *Server) serveEntities(w http.ResponseWriter, req *Request) {
+	var (
+		parts  = strings.Split(strings.Trim(req.Path, "/"), "/")
+		entity *witgo.Entity
+		value  *witgo.Value
+		found  bool
+		names  []string
+		err    error
+	)
+	if len(parts) == 1 {
+		switch req.Method {
+		case "GET":
+			names = []string{}
+			for name := range s.entities {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			writeJSON(w, http.StatusOK, names)
+		case "POST":
+			entity = &witgo.Entity{}
+			if err = json.Unmarshal(req.Body, entity); err != nil {
+				writeError(w, http.StatusBadRequest, "bad-request", err.Error())
+				return
+			}
+			if entityID(entity) == "" {
+				writeError(w, http.StatusBadRequest, "bad-request", "Missing entity id")
+				return
+			}
+			s.entities[entityID(entity)] = entity
+			writeJSON(w, http.StatusOK, entity)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "bad-request", "Method not allowed")
+		}
+		return
+	}
+	if entity, found = s.entities[parts[1]]; !found {
+		writeError(w, http.StatusNotFound, "not-found", fmt.Sprintf("Entity %v not found", parts[1]))
+		return
+	}
+	switch {
+	case len(parts) == 2 && req.Method == "GET":
+		writeJSON(w, http.StatusOK, entity)
+	case len(parts) == 2 && req.Method == "PUT":
+		if err = json.Unmarshal(req.Body, entity); err != nil {
+			writeError(w, http.StatusBadRequest, "bad-request", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, entity)
+	case len(parts) == 2 && req.Method == "DELETE":
+		delete(s.entities, parts[1])
+		writeJSON(w, http.StatusOK, map[string]string{"deleted": parts[1]})
+	case len(parts) == 3 && parts[2] == "values" && req.Method == "POST":
+		value = &witgo.Value{}
+		if err = json.Unmarshal(req.Body, value); err != nil {
+			writeError(w, http.StatusBadRequest, "bad-request", err.Error())
+			return
+		}
+		entity.Values = append(entity.Values, value)
+		writeJSON(w, http.StatusOK, entity)
+	case len(parts) == 4 && parts[2] == "values" && req.Method == "DELETE":
+		for i, v := range entity.Values {
+			if v.Value == parts[3] {
+				entity.Values = append(entity.Values[:i], entity.Values[i+1:]...)
+				writeJSON(w, http.StatusOK, map[string]string{"deleted": parts[3]})
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "not-found", fmt.Sprintf("Value %v not found", parts[3]))
+	default:
+		writeError(w, http.StatusNotFound, "not-found", fmt.Sprintf("Unknown endpoint %v %v", req.Method, req.Path))
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witgotest
+
+import (
+	"errors"
+	"github.com/kurrik/witgo/v1/witgo"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerRecordsRequests(t *testing.T) {
+	var (
+		server   = NewServer()
+		response *witgo.Response
+		message  *witgo.MessageResponse
+		step     *witgo.ConverseResponse
+		requests []*Request
+		err      error
+	)
+	defer server.Close()
+	server.AddMessage("weather in Paris", &witgo.MessageResponse{
+		Entities: witgo.EntityMap{"location": {{Value: "Paris", Confidence: 1}}},
+	})
+	server.AddConverse("s", &witgo.ConverseResponse{Type: "msg", Msg: "Hi!"})
+	if response, err = server.Client.Message("weather in Paris"); err != nil {
+		t.Fatal(err)
+	}
+	if err = response.Parse(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Text != "weather in Paris" || message.MsgID == "" || message.Entities["location"][0].Value != "Paris" {
+		t.Fatalf("Expected the scripted message, got %+v", message)
+	}
+	var tests = []struct {
+		session witgo.SessionID
+		want    string
+	}{
+		{"s", "msg"},
+		{"s", "stop"},
+		{"other", "stop"},
+	}
+	for _, test := range tests {
+		if response, err = server.Client.Converse(test.session, "hello", witgo.Context{"loc": "Paris"}); err != nil {
+			t.Fatal(err)
+		}
+		step = nil
+		if err = response.Parse(&step); err != nil || step.Type != test.want {
+			t.Errorf("%v: got step %+v and error %v, want %v", test.session, step, err, test.want)
+		}
+	}
+	if requests = server.RequestsFor("/converse"); len(requests) != 3 {
+		t.Fatalf("Expected 3 converse requests, got %v", len(requests))
+	}
+	if requests[0].SessionID != "s" || requests[0].Q != "hello" || requests[0].Context["loc"] != "Paris" {
+		t.Fatalf("Expected the converse request to be recorded, got %+v", requests[0])
+	}
+	if requests = server.Requests(); len(requests) != 4 || requests[0].Q != "weather in Paris" {
+		t.Fatalf("Expected every request to be recorded in order, got %v", len(requests))
+	}
+}
+
+func TestServerRejectsBadToken(t *testing.T) {
+	var (
+		server   = NewServer()
+		client   = witgo.NewClient("wrong", witgo.WithBaseURL(server.URL))
+		response *witgo.Response
+		out      *witgo.MessageResponse
+		respErr  witgo.ResponseError
+		err      error
+	)
+	defer server.Close()
+	if response, err = client.Message("hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err = response.Parse(&out); !errors.As(err, &respErr) || respErr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a 401 ResponseError, got %v", err)
+	}
+}
+
+func TestServerEntities(t *testing.T) {
+	var server = NewServer()
+	defer server.Close()
+	server.AddEntity(&witgo.Entity{ID: "city", Values: []*witgo.Value{{Value: "Paris"}}})
+	var tests = []struct {
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"GET", "/entities", "", 200, `["city"]`},
+		{"POST", "/entities", `{"id": "color"}`, 200, `"id":"color"`},
+		{"GET", "/entities", "", 200, `["city","color"]`},
+		{"POST", "/entities/city/values", `{"value": "Lyon"}`, 200, `"value":"Lyon"`},
+		{"DELETE", "/entities/city/values/Paris", "", 200, `{"deleted":"Paris"}`},
+		{"DELETE", "/entities/city/values/Paris", "", 404, "not-found"},
+		{"GET", "/entities/city", "", 200, `"value":"Lyon"`},
+		{"DELETE", "/entities/color", "", 200, `{"deleted":"color"}`},
+		{"GET", "/entities/color", "", 404, "not-found"},
+		{"POST", "/entities", `{}`, 400, "Missing entity id"},
+		{"GET", "/unknown", "", 404, "not-found"},
+	}
+	for _, test := range tests {
+		var (
+			request  *http.Request
+			response *http.Response
+			body     []byte
+			err      error
+		)
+		if request, err = http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body)); err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+server.Token)
+		if response, err = http.DefaultClient.Do(request); err != nil {
+			t.Fatal(err)
+		}
+		body, err = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != test.status || !strings.Contains(string(body), test.want) {
+			t.Errorf("%v %v: got %v %s, want %v containing %v", test.method, test.path, response.StatusCode, body, test.status, test.want)
+		}
+	}
+}